@@ -0,0 +1,107 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// bitbang-scan scans a bit-banged I²C bus and prints the responding addresses
+// in a grid like i2cdetect.
+//
+// It exits with a non-zero status if no device responds.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"periph.io/x/periph/conn/gpio/gpioreg"
+	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/experimental/devices/bitbang"
+	"periph.io/x/periph/host"
+)
+
+// scan scans bus and prints the grid to w.
+//
+// It returns the number of devices found.
+func scan(w io.Writer, bus *bitbang.I2C) (int, error) {
+	found, err := bus.Scan()
+	if err != nil {
+		return 0, err
+	}
+	printGrid(w, found)
+	return len(found), nil
+}
+
+// printGrid prints the 7-bit addresses in a grid of 16 columns. Addresses
+// not scanned are left blank.
+func printGrid(w io.Writer, found []uint16) {
+	ok := map[uint16]bool{}
+	for _, a := range found {
+		ok[a] = true
+	}
+	fmt.Fprint(w, "    ")
+	for c := 0; c < 16; c++ {
+		fmt.Fprintf(w, "  %x", c)
+	}
+	fmt.Fprint(w, "\n")
+	for row := uint16(0); row < 0x80; row += 16 {
+		fmt.Fprintf(w, "%02x:", row)
+		for a := row; a < row+16 && a <= 0x77; a++ {
+			switch {
+			case a < 0x08:
+				fmt.Fprint(w, "   ")
+			case ok[a]:
+				fmt.Fprintf(w, " %02x", a)
+			default:
+				fmt.Fprint(w, " --")
+			}
+		}
+		fmt.Fprint(w, "\n")
+	}
+}
+
+func mainImpl() error {
+	scl := flag.String("scl", "", "SCL pin name")
+	sda := flag.String("sda", "", "SDA pin name")
+	hz := flag.Int("hz", 100000, "I²C bus speed in Hz")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		return errors.New("unexpected argument, try -help")
+	}
+	if *scl == "" || *sda == "" {
+		return errors.New("-scl and -sda are required")
+	}
+
+	if _, err := host.Init(); err != nil {
+		return err
+	}
+	clk := gpioreg.ByName(*scl)
+	if clk == nil {
+		return fmt.Errorf("invalid SCL pin %q", *scl)
+	}
+	data := gpioreg.ByName(*sda)
+	if data == nil {
+		return fmt.Errorf("invalid SDA pin %q", *sda)
+	}
+	bus, err := bitbang.New(clk, data, physic.Frequency(*hz)*physic.Hertz)
+	if err != nil {
+		return err
+	}
+	defer bus.Close()
+	n, err := scan(os.Stdout, bus)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("no device found")
+	}
+	return nil
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "bitbang-scan: %s.\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"periph.io/x/periph/conn/gpio/gpiotest"
+	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/experimental/devices/bitbang"
+)
+
+func TestScan_None(t *testing.T) {
+	// Nothing drives SDA low so no address is acknowledged.
+	bus, err := bitbang.New(&gpiotest.Pin{N: "SCL"}, &gpiotest.Pin{N: "SDA"}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	n, err := scan(&b, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal(n)
+	}
+	lines := strings.Split(b.String(), "\n")
+	expected := []string{
+		"      0  1  2  3  4  5  6  7  8  9  a  b  c  d  e  f",
+		"00:                         -- -- -- -- -- -- -- --",
+		"10: -- -- -- -- -- -- -- -- -- -- -- -- -- -- -- --",
+	}
+	for x, l := range expected {
+		if lines[x] != l {
+			t.Fatalf("line %d: %q != %q", x, lines[x], l)
+		}
+	}
+	if l := lines[8]; l != "70: -- -- -- -- -- -- -- --" {
+		t.Fatalf("%q", l)
+	}
+}
+
+func TestScan_All(t *testing.T) {
+	// The simulated device acknowledges every address.
+	bus, _ := bitbang.NewCapture()
+	var b bytes.Buffer
+	n, err := scan(&b, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0x78-0x08 {
+		t.Fatal(n)
+	}
+	if !strings.Contains(b.String(), "\n00:                         08 09 0a 0b 0c 0d 0e 0f\n") {
+		t.Fatal(b.String())
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"periph.io/x/periph/conn/i2c/i2ctest"
+)
+
+// NewCapture returns a bit-banged I²C bus over two simulated pins, connected
+// to a simulated device that acknowledges everything and records the
+// transactions.
+//
+// No GPIO is used and the bus is not shared, so it doesn't need to be closed.
+// The recorded operations can be used as a script for i2ctest.Playback or
+// NewPlayback.
+func NewCapture() (*I2C, *Capture) {
+	c := &Capture{p: NewPlayback(nil)}
+	c.p.capture = c
+	return c.p.I2C, c
+}
+
+// Capture records the transactions done on a bus returned by NewCapture.
+type Capture struct {
+	p *Playback
+	// Responder returns the bytes to send when the device at addr is read,
+	// after w was written in the same transaction. Bytes past the end read as
+	// 0. If nil, all the bytes read are 0.
+	//
+	// It must be set before the bus is used.
+	Responder func(addr uint16, w []byte) []byte
+}
+
+// Ops returns the transactions completed so far.
+func (c *Capture) Ops() []i2ctest.IO {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	out := make([]i2ctest.IO, c.p.Count)
+	copy(out, c.p.Ops)
+	return out
+}
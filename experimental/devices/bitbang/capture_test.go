@@ -0,0 +1,69 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"reflect"
+	"testing"
+
+	"periph.io/x/periph/conn/i2c/i2ctest"
+)
+
+func TestCapture(t *testing.T) {
+	bus, c := NewCapture()
+	c.Responder = func(addr uint16, w []byte) []byte {
+		if addr == 0x10 && len(w) == 1 && w[0] == 0x03 {
+			return []byte{0xA5}
+		}
+		return nil
+	}
+	if err := bus.TxSequence(0x10, []Op{{Buf: []byte{0x01, 0x02}}}); err != nil {
+		t.Fatal(err)
+	}
+	r := make([]byte, 2)
+	if err := bus.TxRepeatedStart(0x10, []byte{0x03}, r); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0xA5, 0x00}; !reflect.DeepEqual(r, expected) {
+		t.Fatalf("%#v != %#v", r, expected)
+	}
+	r = make([]byte, 1)
+	if err := bus.Tx(0x3C0, []byte{0x04}, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := []i2ctest.IO{
+		{Addr: 0x10, W: []byte{0x01, 0x02}},
+		{Addr: 0x10, W: []byte{0x03}, R: []byte{0xA5, 0x00}},
+		{Addr: 0x3C0, W: []byte{0x04}, R: []byte{0x00}},
+	}
+	if ops := c.Ops(); !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("%#v != %#v", ops, expected)
+	}
+
+	// The captured operations can be played back.
+	p := NewPlayback(expected)
+	if err := p.TxSequence(0x10, []Op{{Buf: []byte{0x01, 0x02}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.TxRepeatedStart(0x10, []byte{0x03}, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Tx(0x3C0, []byte{0x04}, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCapture_NotRegistered(t *testing.T) {
+	bus, _ := NewCapture()
+	busesMu.Lock()
+	_, ok := buses[busKey{bus.scl, bus.sda}]
+	busesMu.Unlock()
+	if ok {
+		t.Fatal("expected the bus to not be registered")
+	}
+}
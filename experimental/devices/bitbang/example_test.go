@@ -0,0 +1,84 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang_test
+
+import (
+	"fmt"
+	"log"
+
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"periph.io/x/periph/experimental/devices/bitbang"
+	"periph.io/x/periph/experimental/devices/lc709203"
+)
+
+func ExampleNewPlayback() {
+	// Simulate a LC709203F fuel gauge. Reads return the value in little endian
+	// followed by a CRC-8.
+	bus := bitbang.NewPlayback([]i2ctest.IO{
+		// Set the power mode to operational.
+		{Addr: 0x0B, W: []byte{0x15, 0x01, 0x00, 0x64}},
+		// Read the IC version.
+		{Addr: 0x0B, W: []byte{0x11}, R: []byte{0x01, 0x03, 0xA0}},
+		// Read the RSOC.
+		{Addr: 0x0B, W: []byte{0x0D}, R: []byte{0x2A, 0x00, 0x1F}},
+	})
+	defer func() {
+		// Verifies that all the expected transactions happened.
+		if err := bus.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	dev, err := lc709203.New(bus, &lc709203.DefaultOpts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rsoc, err := dev.RSOC()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%s: %d%%\n", dev, rsoc)
+	// Output:
+	// LC709203F: 42%
+}
+
+func ExampleNewCapture() {
+	bus, c := bitbang.NewCapture()
+	// Simulate the registers of a LC709203F fuel gauge. Reads return the value
+	// in little endian followed by a CRC-8.
+	c.Responder = func(addr uint16, w []byte) []byte {
+		if addr != lc709203.I2CAddr || len(w) != 1 {
+			return nil
+		}
+		var r []byte
+		switch w[0] {
+		case 0x11:
+			// IC version.
+			r = []byte{0x01, 0x03}
+		case 0x0D:
+			// RSOC of 100%.
+			r = []byte{0x64, 0x00}
+		default:
+			return nil
+		}
+		a := byte(addr << 1)
+		return append(r, lc709203.CRC8([]byte{a, w[0], a | 1, r[0], r[1]}))
+	}
+
+	dev, err := lc709203.New(bus, &lc709203.DefaultOpts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rsoc, err := dev.RSOC()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%s: %d%%\n", dev, rsoc)
+	// The transactions done can be used to create a playback.
+	fmt.Printf("%d transactions\n", len(c.Ops()))
+	// Output:
+	// LC709203F: 100%
+	// 3 transactions
+}
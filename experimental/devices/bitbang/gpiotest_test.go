@@ -0,0 +1,220 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpiotest"
+	"periph.io/x/periph/conn/physic"
+)
+
+func TestGPIOTest_Tx(t *testing.T) {
+	i, s, cleanup := newTestBus(t, 0x10)
+	defer cleanup()
+	if err := i.Tx(0x10, []byte{0xA5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		// START
+		"D0", "C0",
+		// Address 0x10<<1; SDA is already low for the slave's ACK.
+		"C1", "C0", "C1", "C0", "D1", "C1", "C0", "D0", "C1", "C0",
+		"C1", "C0", "C1", "C0", "C1", "C0", "C1", "C0",
+		"C1", "C0",
+		// The slave releases SDA, then the master drives it low.
+		"D1", "D0",
+		// 0xA5
+		"D1", "C1", "C0", "D0", "C1", "C0", "D1", "C1", "C0", "D0",
+		"C1", "C0", "C1", "C0", "D1", "C1", "C0", "D0", "C1", "C0",
+		"D1", "C1", "C0",
+		// The slave pulls SDA low right after the 8th falling edge.
+		"D0", "C1", "C0", "D1", "D0",
+		// STOP
+		"C1", "D1",
+	}
+	if !reflect.DeepEqual(s.trace, expected) {
+		t.Fatalf("unexpected trace\n%v\n%v", s.trace, expected)
+	}
+	if expected := []byte{0x10 << 1, 0xA5}; !reflect.DeepEqual(s.acked, expected) {
+		t.Fatalf("%#v != %#v", s.acked, expected)
+	}
+}
+
+func TestGPIOTest_NACK(t *testing.T) {
+	i, s, cleanup := newTestBus(t, 0x10)
+	defer cleanup()
+	err := i.Tx(0x11, []byte{0xA5}, nil)
+	if e, ok := err.(*NACKError); !ok || e.Phase != "address" {
+		t.Fatal(err)
+	}
+	if len(s.acked) != 0 {
+		t.Fatalf("%#v", s.acked)
+	}
+	if s.stops != 1 {
+		t.Fatalf("stops=%d", s.stops)
+	}
+	if !s.scl.Read() || !s.sda.Read() {
+		t.Fatal("expected the bus to be idle")
+	}
+}
+
+//
+
+// newTestBus returns a bus over two gpiotest.Pin, with a slave at addr
+// emulated by a goroutine, and a function to close the bus and stop the
+// goroutine.
+func newTestBus(t *testing.T, addr uint16) (*I2C, *testSlave, func()) {
+	s := &testSlave{
+		addr:  addr,
+		edges: make(chan string),
+		done:  make(chan struct{}),
+	}
+	s.scl = &testPin{Pin: &gpiotest.Pin{N: "SCL", L: gpio.High}, s: s, c: "C", master: gpio.High, slave: gpio.High}
+	s.sda = &testPin{Pin: &gpiotest.Pin{N: "SDA", L: gpio.High}, s: s, c: "D", master: gpio.High, slave: gpio.High}
+	go s.run()
+	i, err := New(s.scl, s.sda, physic.MegaHertz)
+	if err != nil {
+		close(s.edges)
+		t.Fatal(err)
+	}
+	i.delay = func(d time.Duration) {}
+	s.trace = nil
+	return i, s, func() {
+		if err := i.Close(); err != nil {
+			t.Error(err)
+		}
+		close(s.edges)
+	}
+}
+
+// testSlave is a slave that acknowledges the bytes written to addr.
+//
+// The changes of the lines caused by the master are sent to the goroutine
+// running run, and the master waits for the slave to handle each of them.
+type testSlave struct {
+	addr     uint16
+	scl, sda *testPin
+	edges    chan string
+	done     chan struct{}
+
+	// Only accessed by run, or once the master is done.
+	trace  []string
+	acked  []byte
+	stops  int
+	active bool
+	first  bool // Receiving the address.
+	ack    bool // The 9th clock is in progress.
+	bit    int
+	cur    byte
+}
+
+func (s *testSlave) run() {
+	for e := range s.edges {
+		s.trace = append(s.trace, e)
+		s.onEdge(e)
+		s.done <- struct{}{}
+	}
+}
+
+func (s *testSlave) onEdge(e string) {
+	switch e {
+	case "D0":
+		if s.scl.Read() {
+			// START
+			s.active, s.first, s.ack, s.bit, s.cur = true, true, false, 0, 0
+		}
+	case "D1":
+		if s.scl.Read() {
+			// STOP
+			s.active = false
+			s.stops++
+		}
+	case "C1":
+		if s.active && s.bit < 8 {
+			s.cur <<= 1
+			if s.sda.Read() {
+				s.cur |= 1
+			}
+			s.bit++
+		}
+	case "C0":
+		if !s.active {
+			return
+		}
+		if s.ack {
+			// End of the 9th clock.
+			s.drive(gpio.High)
+			s.first, s.ack, s.bit, s.cur = false, false, 0, 0
+			return
+		}
+		if s.bit == 8 {
+			// Right after the 8th falling edge, so SDA is stable before the 9th
+			// rising edge.
+			if s.first && uint16(s.cur>>1) != s.addr {
+				s.active = false
+				return
+			}
+			s.acked = append(s.acked, s.cur)
+			s.ack = true
+			s.drive(gpio.Low)
+		}
+	}
+}
+
+// drive sets the level driven by the slave on SDA.
+func (s *testSlave) drive(l gpio.Level) {
+	s.sda.slave = l
+	if old, l := s.sda.update(); l != old {
+		s.trace = append(s.trace, "D"+levelStr(l))
+	}
+}
+
+// testPin is a gpiotest.Pin shared by the master and a testSlave.
+//
+// The line is a wired-AND: it is low as long as either side drives it low.
+// Each change caused by the master is notified to the slave.
+type testPin struct {
+	*gpiotest.Pin
+	s      *testSlave
+	c      string     // "C" or "D".
+	master gpio.Level // High when released by the master.
+	slave  gpio.Level // High when released by the slave.
+}
+
+func (p *testPin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.Pin.Lock()
+	p.Pin.P = pull
+	p.Pin.Unlock()
+	p.master = gpio.High
+	p.notify(p.update())
+	return nil
+}
+
+func (p *testPin) Out(l gpio.Level) error {
+	p.master = l
+	p.notify(p.update())
+	return nil
+}
+
+// update sets the level of the line from both sides and returns the previous
+// and new levels.
+func (p *testPin) update() (gpio.Level, gpio.Level) {
+	old := p.Pin.Read()
+	l := p.master && p.slave
+	_ = p.Pin.Out(l)
+	return old, l
+}
+
+// notify sends the new level to the slave if it changed.
+func (p *testPin) notify(old, l gpio.Level) {
+	if l != old {
+		p.s.edges <- p.c + levelStr(l)
+		<-p.s.done
+	}
+}
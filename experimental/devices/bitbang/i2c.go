@@ -9,250 +9,2269 @@
 package bitbang
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"periph.io/x/periph/conn"
 	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpioreg"
 	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2creg"
 	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/conn/pin"
 	"periph.io/x/periph/host/cpu"
 )
 
 // SkipAddr can be used to skip the address from being sent.
+//
+// No address byte is sent in any phase of the transaction. Tx and TxSequence
+// then produce a START, the bytes written, a repeated START before the bytes
+// read for TxRepeatedStart or between each Op, then a STOP.
 const SkipAddr uint16 = 0xFFFF
 
-// New returns an object that communicates I²C over two pins.
+// MSBFirst documents the bit order on the wire: each byte is shifted out and
+// in most significant bit first.
+//
+// Page 10, section 3.1.5 Byte format. It is not configurable.
+const MSBFirst = true
+
+// MaxSpeed is the fastest speed supported.
 //
-// BUG(maruel): It is close to working but not yet, the signal is incorrect
-// during ACK.
+// Toggling GPIOs from user space cannot realistically sustain faster speeds,
+// which matches I²C Fast-mode Plus.
+const MaxSpeed = physic.MegaHertz
+
+// DefaultClockStretchTimeout is the default maximum duration a slave may hold
+// SCL low.
+const DefaultClockStretchTimeout = 100 * time.Millisecond
+
+// DefaultDataSetupTime is the default duration SDA is stable before SCL
+// rises, tSU;DAT in standard mode. See table 10 in section 6.1 of UM10204.
+const DefaultDataSetupTime = 250 * time.Nanosecond
+
+var (
+	// ErrClockStretchTimeout is returned when a slave held SCL low for longer
+	// than the clock stretch timeout.
+	ErrClockStretchTimeout = errors.New("bitbang-i2c: clock stretch timeout")
+	// ErrArbitrationLost is returned when another master took over the bus in
+	// the middle of a transaction.
+	ErrArbitrationLost = errors.New("bitbang-i2c: arbitration lost")
+	// ErrBusBusy is returned when the bus is not idle when starting a
+	// transaction, even after trying to clear it; see Recover.
+	ErrBusBusy = errors.New("bitbang-i2c: bus busy")
+	// ErrClosed is returned when the bus is used after Close.
+	ErrClosed = errors.New("bitbang-i2c: bus closed")
+	// ErrHalted is returned by a transaction aborted by Halt.
+	ErrHalted = errors.New("bitbang-i2c: halted")
+	// ErrACKTimeout is returned when the ACK of a byte written couldn't be
+	// sampled within the ACK timeout. The lines are released without a STOP
+	// condition, as SCL may still be held low.
+	ErrACKTimeout = errors.New("bitbang-i2c: ACK timeout")
+)
+
+// NACKError is returned when the slave didn't acknowledge a byte.
+type NACKError struct {
+	// Phase is one of "address", "write" or "read-restart".
+	Phase string
+	// Index is the index of the byte in w for the "write" phase, or the index
+	// of the address byte otherwise.
+	Index int
+	// Value is the byte that was not acknowledged.
+	Value byte
+}
+
+func (e *NACKError) Error() string {
+	return fmt.Sprintf("bitbang-i2c: got NACK on %s byte %d (0x%02X)", e.Phase, e.Index, e.Value)
+}
+
+// NACKsError is returned with NACKContinue when the slave didn't acknowledge
+// some of the bytes written.
+type NACKsError struct {
+	// NACKs lists the bytes not acknowledged, in order.
+	NACKs []NACKError
+}
+
+func (e *NACKsError) Error() string {
+	var b bytes.Buffer
+	b.WriteString("bitbang-i2c: got NACK on write bytes ")
+	for x, n := range e.NACKs {
+		if x != 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%d (0x%02X)", n.Index, n.Value)
+	}
+	return b.String()
+}
+
+// RetryError is returned by TxRetry when all the attempts failed.
+type RetryError struct {
+	// Attempts is the number of transactions tried.
+	Attempts int
+	// Err is the error of the last attempt, for example a *NACKError or
+	// ErrArbitrationLost.
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("bitbang-i2c: failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// NACKPolicy selects what happens when a byte written is not acknowledged.
+type NACKPolicy int
+
+const (
+	// NACKAbort stops the transaction on the first byte not acknowledged and
+	// returns a *NACKError. It is the default.
+	NACKAbort NACKPolicy = iota
+	// NACKContinue writes all the bytes anyway and returns a *NACKsError
+	// listing those not acknowledged.
+	NACKContinue
+)
+
+// Diagnostics is the timing of the lines recorded during a transaction; see
+// SetDiagnostics.
+type Diagnostics struct {
+	// StretchCycles is the number of half-cycles spent waiting for SCL to be
+	// released, while a slave stretched the clock.
+	StretchCycles int
+	// RiseTimeNeeded is true if SCL read low right after being released but
+	// high when read again, without waiting. It means the rise time of SCL is
+	// about as long as accessing the GPIO, so the pull-ups are likely too weak
+	// for the speed; see SetRiseTime.
+	RiseTimeNeeded bool
+}
+
+// New returns an object that communicates I²C over two pins.
 //
 // It has two special features:
 // - Special address SkipAddr can be used to skip the address from being
 //   communicated
 // - An arbitrary speed can be used
+//
+// The bus is shared: calling New again with the same pins returns the same
+// *I2C, as long as f is the same, and each call must be matched by one call to
+// Close. The pins are only released when the last reference is closed. Using
+// a pin already used by another bus returns an error.
 func New(clk gpio.PinIO, data gpio.PinIO, f physic.Frequency) (*I2C, error) {
+	if err := checkSpeed(f); err != nil {
+		return nil, err
+	}
+	if clk == nil || data == nil {
+		return nil, errors.New("bitbang-i2c: SCL and SDA pins are required")
+	}
+	if clk.Name() == data.Name() {
+		return nil, fmt.Errorf("bitbang-i2c: SCL and SDA must be different pins, got %s twice", clk)
+	}
+	key := newBusKey(clk, data)
+	shared := isComparable(key.scl) && isComparable(key.sda)
+	if shared {
+		busesMu.Lock()
+		defer busesMu.Unlock()
+		if i, err := sharedBus(key, f); i != nil || err != nil {
+			return i, err
+		}
+	}
+	i, err := newI2C(clk, data, f)
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		buses[key] = i
+	}
+	return i, nil
+}
+
+// newI2C configures the pins and returns a bus that is not shared.
+func newI2C(clk, data gpio.PinIO, f physic.Frequency) (*I2C, error) {
 	// Spec calls to idle at high. Page 8, section 3.1.1.
 	// Set SCL as pull-up.
 	if err := clk.In(gpio.PullUp, gpio.NoEdge); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bitbang-i2c: SCL pin %s doesn't support input with pull-up: %v", clk, err)
 	}
+	pullups := readsHigh(clk)
 	if err := clk.Out(gpio.High); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bitbang-i2c: SCL pin %s doesn't support output: %v", clk, err)
 	}
+	readsBack := readsHigh(clk)
 	// Set SDA as pull-up.
 	if err := data.In(gpio.PullUp, gpio.NoEdge); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bitbang-i2c: SDA pin %s doesn't support input with pull-up: %v", data, err)
 	}
+	pullups = readsHigh(data) && pullups
 	if err := data.Out(gpio.High); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bitbang-i2c: SDA pin %s doesn't support output: %v", data, err)
 	}
+	readsBack = readsHigh(data) && readsBack
 	i := &I2C{
-		scl:       clk,
-		sda:       data,
-		halfCycle: f.Period() / 2,
+		scl:            clk,
+		sda:            data,
+		sclOpenDrain:   setOpenDrain(clk),
+		sdaOpenDrain:   setOpenDrain(data),
+		halfCycle:      f.Period() / 2,
+		low:            f.Period() / 2,
+		high:           f.Period() / 2,
+		startHold:      f.Period() / 2,
+		stopSetup:      f.Period() / 2,
+		stretchTimeout: DefaultClockStretchTimeout,
+		ctx:            context.Background(),
+		needsPullups:   !pullups,
+		votes:          1,
+		delay:          sleep,
+		now:            time.Now,
+		sleepFn:        time.Sleep,
+		spin:           cpu.Nanospin,
+		dataSetup:      DefaultDataSetupTime,
+		readsBack:      readsBack,
+		refs:           1,
 	}
+	i.period = int64(i.low + i.high)
+	// Both lines were driven high to check they read back; stop driving them.
+	i.release()
 	return i, nil
 }
 
+// Register registers a bit-banged I²C bus named name in i2creg, using the
+// GPIO pins named clk and data as found in gpioreg.
+//
+// The bus can then be opened with i2creg.Open(name). Each call to Open returns
+// a reference to the same bus, which must be closed; see New.
+func Register(name string, clk, data string, f physic.Frequency) error {
+	if err := checkSpeed(f); err != nil {
+		return err
+	}
+	scl := gpioreg.ByName(clk)
+	if scl == nil {
+		return fmt.Errorf("bitbang-i2c: can't find SCL pin %q", clk)
+	}
+	sda := gpioreg.ByName(data)
+	if sda == nil {
+		return fmt.Errorf("bitbang-i2c: can't find SDA pin %q", data)
+	}
+	return i2creg.Register(name, nil, -1, func() (i2c.BusCloser, error) {
+		return New(scl, sda, f)
+	})
+}
+
 // I2C represents an I²C master implemented as bit-banging on 2 GPIO pins.
 type I2C struct {
-	mu        sync.Mutex
-	scl       gpio.PinIO // Clock line
-	sda       gpio.PinIO // Data line
-	halfCycle time.Duration
+	// period is the SCL period configured by New, SetSpeed or SetClockTiming,
+	// in nanoseconds; accessed atomically, so String doesn't take mu. It is
+	// first to be 64-bit aligned on 32-bit platforms.
+	period          int64
+	mu              sync.Mutex
+	scl             gpio.PinIO // Clock line
+	sda             gpio.PinIO // Data line
+	sclOpenDrain    bool       // SCL is a true open-drain output.
+	sdaOpenDrain    bool       // SDA is a true open-drain output.
+	halfCycle       time.Duration
+	low             time.Duration // SCL low period.
+	high            time.Duration // SCL high period.
+	startHold       time.Duration // tHD;STA; see SetStartStopTiming.
+	stopSetup       time.Duration // tSU;STO; see SetStartStopTiming.
+	stretchTimeout  time.Duration
+	txTimeout       time.Duration
+	riseTime        time.Duration
+	wake            bool
+	logf            func(format string, args ...interface{})
+	delay           func(d time.Duration)
+	now             func() time.Time
+	sleepFn         func(d time.Duration)
+	spin            func(d time.Duration)
+	busy            int32           // Set during a transaction; accessed atomically.
+	ctx             context.Context // Context of the current transaction.
+	cancel          context.CancelFunc
+	closed          bool
+	halt            int32 // Set by Halt to abort the transaction; accessed atomically.
+	needsPullups    bool
+	votes           int // Number of SDA samples; see SetSampleVotes.
+	refs            int // Number of references returned by New; guarded by busesMu.
+	ackTimeout      time.Duration
+	actualSpeed     physic.Frequency // Measured by ActualSpeed; 0 if not yet.
+	realtime        bool
+	restorePriority func()        // Set during a transaction when realtime is enabled.
+	persistent      bool          // Configure the pins again before each transaction.
+	dataSetup       time.Duration // tSU;DAT; see SetDataSetupTime.
+	readSettle      time.Duration // Wait before sampling a bit read; see SetReadSettle.
+	lastStop        time.Time     // Time of the last STOP condition; see start.
+	readsBack       bool          // Both lines read high when driven high in New.
+	blind           bool          // The lines are never read; see SetBlind.
+	allowReserved   bool          // See SetAllowReservedAddresses.
+	pushPullClock   bool          // SCL is driven high; see SetPushPullClock.
+	granularity     time.Duration // Shortest sleep measured by Calibrate.
+	nackPolicy      NACKPolicy    // See SetNACKPolicy.
+	diagnostics     bool          // See SetDiagnostics.
+	diag            Diagnostics   // Of the current or last transaction.
 }
 
 func (i *I2C) String() string {
-	return fmt.Sprintf("bitbang/i2c(%s, %s)", i.scl, i.sda)
+	return fmt.Sprintf("bitbang/i2c(%s, %s)@%s", i.scl, i.sda, i.Speed())
 }
 
 // Close implements i2c.BusCloser.
+//
+// It releases a reference returned by New. When the last one is released, it
+// releases both pins as high-impedance inputs so they can be used by something
+// else and subsequent transactions return ErrClosed. Calling Close once the
+// bus is closed is a no-op.
 func (i *I2C) Close() error {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return nil
+	}
+	if i.refs--; i.refs > 0 {
+		return nil
+	}
+	if key := newBusKey(i.scl, i.sda); buses[key] == i {
+		delete(buses, key)
+	}
+	i.closed = true
+	err := i.scl.In(gpio.Float, gpio.NoEdge)
+	if err2 := i.sda.In(gpio.Float, gpio.NoEdge); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Halt implements conn.Resource.
+//
+// It aborts the transaction in progress, if any, and leaves both lines
+// released. Unlike Close, the bus can still be used afterward.
+func (i *I2C) Halt() error {
+	atomic.StoreInt32(&i.halt, 1)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	atomic.StoreInt32(&i.halt, 0)
+	if i.closed {
+		return nil
+	}
+	i.release()
 	return nil
 }
 
 // Tx implements i2c.Bus.
+//
+// Addresses above 0x7F are sent using 10-bit addressing. Reserved 7-bit
+// addresses are rejected unless allowed with SetAllowReservedAddresses.
+//
+// When both w and r are not empty, w is written then a repeated START is
+// issued and the address is sent again with R/W set before reading r, as
+// expected by most devices for a register read.
+//
+// The R/W bit of the address is set only when w is empty and r is not. When
+// both w and r are nil, only the address is sent with R/W cleared; this is a
+// probe that returns a *NACKError if no device acknowledged. Empty but non-nil
+// buffers are rejected as the intended direction is ambiguous.
+//
+// On error, r is zeroed, even if some bytes were read. This is also the case
+// for all the other transaction methods.
 func (i *I2C) Tx(addr uint16, w, r []byte) error {
+	return i.TxContext(context.Background(), addr, w, r)
+}
+
+// WriteRead writes w then reads r from the device at addr, with a repeated
+// START in between.
+//
+// It is the same as Tx and is provided for code written against a bus with
+// this method name.
+func (i *I2C) WriteRead(addr uint16, w, r []byte) error {
+	return i.Tx(addr, w, r)
+}
+
+// TxContext is like Tx but aborts the transaction when ctx is done.
+//
+// The context is checked between bytes and while waiting for a slave
+// stretching the clock. A STOP condition is always issued before returning.
+func (i *I2C) TxContext(ctx context.Context, addr uint16, w, r []byte) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	//syscall.Setpriority(which, who, prio)
+	return i.tx(ctx, addr, w, r, false)
+}
 
-	i.start()
-	defer i.stop()
-	if addr != SkipAddr {
-		if addr > 0xFF {
-			// Page 15, section 3.1.11 10-bit addressing
-			// TODO(maruel): Implement if desired; prefix 0b11110xx.
-			return errors.New("bitbang-i2c: invalid address")
-		}
-		// Page 13, section 3.1.10 The slave address and R/W bit
-		addr <<= 1
-		if len(r) == 0 {
-			addr |= 1
-		}
-		ack, err := i.writeByte(byte(addr))
-		if err != nil {
-			return err
-		}
-		if !ack {
-			return errors.New("bitbang-i2c: got NACK")
-		}
+// TxAt is like Tx but uses the speed f for this transaction only.
+//
+// It is useful when devices supporting different speeds share the bus.
+func (i *I2C) TxAt(f physic.Frequency, addr uint16, w, r []byte) error {
+	if err := checkSpeed(f); err != nil {
+		return err
 	}
-	for _, b := range w {
-		ack, err := i.writeByte(b)
-		if err != nil {
-			return err
-		}
-		if !ack {
-			return errors.New("bitbang-i2c: got NACK")
-		}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	h, l, hi, sh, ss := i.halfCycle, i.low, i.high, i.startHold, i.stopSetup
+	defer func() { i.halfCycle, i.low, i.high, i.startHold, i.stopSetup = h, l, hi, sh, ss }()
+	i.setSpeed(f)
+	return i.tx(context.Background(), addr, w, r, false)
+}
+
+// TxRetry is like Tx but tries up to attempts times while the transaction
+// fails with a *NACKError, a *NACKsError or ErrArbitrationLost, sleeping
+// backoff in between.
+//
+// Recover is called after the last failed attempt, and the error of the last
+// attempt is returned in a *RetryError.
+func (i *I2C) TxRetry(addr uint16, w, r []byte, attempts int, backoff time.Duration) error {
+	if attempts < 1 {
+		return errors.New("bitbang-i2c: invalid number of attempts")
 	}
-	for x := range r {
-		var err error
-		r[x], err = i.readByte()
-		if err != nil {
+	var err error
+	for n := 1; ; n++ {
+		if err = i.Tx(addr, w, r); err == nil || !isRetryable(err) {
 			return err
 		}
+		if n == attempts {
+			_ = i.Recover()
+			return &RetryError{Attempts: n, Err: err}
+		}
+		time.Sleep(backoff)
 	}
-	return nil
 }
 
-// SetSpeed implements i2c.Bus.
-func (i *I2C) SetSpeed(f physic.Frequency) error {
+// TxRepeatedStart writes w, then issues a repeated START and reads r.
+//
+// This is the usual register read sequence: the address is sent with R/W
+// cleared, followed by w, then a repeated START and the address again with
+// R/W set, then the read. Tx does the same when w and r are both not empty;
+// TxRepeatedStart also does it when w is empty.
+func (i *I2C) TxRepeatedStart(addr uint16, w, r []byte) error {
+	return i.TxRepeatedStartContext(context.Background(), addr, w, r)
+}
+
+// TxRepeatedStartContext is like TxRepeatedStart but aborts the transaction
+// when ctx is done.
+func (i *I2C) TxRepeatedStartContext(ctx context.Context, addr uint16, w, r []byte) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	i.halfCycle = f.Period() / 2
-	return nil
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return i.tx(ctx, addr, w, r, true)
 }
 
-// SCL implements i2c.Pins.
-func (i *I2C) SCL() gpio.PinIO {
-	return i.scl
+// Op is one operation of a TxSequence.
+type Op struct {
+	// Read is true to read into Buf, false to write Buf.
+	Read bool
+	Buf  []byte
 }
 
-// SDA implements i2c.Pins.
-func (i *I2C) SDA() gpio.PinIO {
-	return i.sda
+// TxStream writes each chunk in order within a single addressed transaction,
+// then issues a repeated START and reads r if it is not empty.
+//
+// It is useful to write a register pointer followed by a large block, for
+// example an EEPROM page, without concatenating them first. The Index of a
+// *NACKError is the index of the byte in the whole stream.
+func (i *I2C) TxStream(addr uint16, chunks [][]byte, r []byte) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return i.stream(context.Background(), addr, chunks, r)
 }
 
+// ReadStream writes w, issues a repeated START then reads r in chunks of up
+// to chunk bytes within a single addressed transaction.
 //
+// It is meant for devices that auto-increment their internal pointer, like
+// large sequential memories. Every byte is ACK'ed except the last one of r.
+// The processor is yielded to other goroutines between chunks, while SCL is
+// held low.
+func (i *I2C) ReadStream(addr uint16, w, r []byte, chunk int) error {
+	if chunk <= 0 {
+		return errors.New("bitbang-i2c: invalid chunk size")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return i.readStream(context.Background(), addr, w, r, chunk)
+}
 
-// "When CLK is a high level and DIO changes from high to low level, data input
-// starts."
+// ReadReg16BE reads the 16-bit big endian register reg of the device at addr.
 //
-// Ends with SDA and SCL low.
+// It writes reg, then reads 2 bytes after a repeated START.
+func (i *I2C) ReadReg16BE(addr uint16, reg byte) (uint16, error) {
+	var b [2]byte
+	if err := i.Tx(addr, []byte{reg}, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+// ReadReg16LE is like ReadReg16BE for a little endian register.
+func (i *I2C) ReadReg16LE(addr uint16, reg byte) (uint16, error) {
+	var b [2]byte
+	if err := i.Tx(addr, []byte{reg}, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b[:]), nil
+}
+
+// ReadReg24BE is like ReadReg16BE for a 24-bit register.
+func (i *I2C) ReadReg24BE(addr uint16, reg byte) (uint32, error) {
+	var b [3]byte
+	if err := i.Tx(addr, []byte{reg}, b[:]); err != nil {
+		return 0, err
+	}
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]), nil
+}
+
+// ReadReg24LE is like ReadReg16LE for a 24-bit register.
+func (i *I2C) ReadReg24LE(addr uint16, reg byte) (uint32, error) {
+	var b [3]byte
+	if err := i.Tx(addr, []byte{reg}, b[:]); err != nil {
+		return 0, err
+	}
+	return uint32(b[2])<<16 | uint32(b[1])<<8 | uint32(b[0]), nil
+}
+
+// TxSequence does a transaction made of multiple operations.
 //
-// Lasts 1/2 cycle.
-func (i *I2C) start() {
-	// Page 9, section 3.1.4 START and STOP conditions
-	// In multi-master mode, it would have to sense SDA first and after the sleep.
-	_ = i.sda.Out(gpio.Low)
-	i.sleepHalfCycle()
-	_ = i.scl.Out(gpio.Low)
+// A single START is issued, then each operation is preceded by the address
+// with the R/W bit matching the operation; operations are separated by a
+// repeated START. A single STOP is issued at the end.
+func (i *I2C) TxSequence(addr uint16, ops []Op) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return i.sequence(context.Background(), addr, ops)
 }
 
-// "When CLK is a high level and DIO changes from low level to high level, data
-// input ends."
+// SetAllowReservedAddresses allows the reserved 7-bit addresses 0x00 to 0x07
+// and 0x78 to 0x7F, for example the general call address 0x00.
 //
-// Lasts 3/2 cycle.
-func (i *I2C) stop() {
-	// Page 9, section 3.1.4 START and STOP conditions
-	_ = i.scl.Out(gpio.Low)
-	i.sleepHalfCycle()
-	_ = i.scl.Out(gpio.High)
-	i.sleepHalfCycle()
-	_ = i.sda.Out(gpio.High)
-	// TODO(maruel): This sleep could be skipped, assuming we wait for the next
-	// transfer if too quick to happen.
-	i.sleepHalfCycle()
+// By default, a transaction with a reserved address returns an error, which
+// catches an 8-bit address passed by mistake. See table 3 in section 3.1.12
+// of UM10204.
+func (i *I2C) SetAllowReservedAddresses(allow bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.allowReserved = allow
 }
 
-// writeByte writes 8 bits then waits for ACK.
+// GeneralCall sends data to all the devices using the general call address
+// 0x00.
 //
-// Expects SDA and SCL low.
+// It returns a *NACKError if no device acknowledged the address or data. It
+// is allowed even if reserved addresses are not; see
+// SetAllowReservedAddresses. See section 3.1.13 of UM10204 for the meaning of
+// data.
+func (i *I2C) GeneralCall(data byte) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer func(allow bool) { i.allowReserved = allow }(i.allowReserved)
+	i.allowReserved = true
+	return i.tx(context.Background(), 0x00, []byte{data}, nil, false)
+}
+
+// SoftwareReset resets the devices that support it with a general call of
+// 0x06.
 //
-// Ends with SDA low and SCL high.
+// The devices reset then load the programmable part of their address from
+// their pins.
+func (i *I2C) SoftwareReset() error {
+	return i.GeneralCall(0x06)
+}
+
+// Probe returns true if a device acknowledges the address addr.
 //
-// Lasts 9 cycles.
-func (i *I2C) writeByte(b byte) (bool, error) {
-	// Page 9, section 3.1.3 Data validity
-	// "The data on te SDA line must be stable during the high period of the
-	// clock."
-	// Page 10, section 3.1.5 Byte format
-	for x := 0; x < 8; x++ {
-		_ = i.sda.Out(b&byte(1<<byte(7-x)) != 0)
-		i.sleepHalfCycle()
-		// Let the device read SDA.
-		// TODO(maruel): Support clock stretching, the device may keep the line low.
-		_ = i.scl.Out(gpio.High)
-		i.sleepHalfCycle()
-		_ = i.scl.Out(gpio.Low)
+// It issues a START, the address with R/W cleared, then a STOP. An error is
+// only returned on a bus fault. Addresses above 0x7F are sent using 10-bit
+// addressing.
+func (i *I2C) Probe(addr uint16) (bool, error) {
+	if addr == SkipAddr {
+		return false, errors.New("bitbang-i2c: invalid address")
 	}
-	// Page 10, section 3.1.6 ACK and NACK
-	// 9th clock is ACK.
-	i.sleepHalfCycle()
-	// SCL was already set as pull-up. PullNoChange
-	if err := i.scl.In(gpio.PullUp, gpio.NoEdge); err != nil {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.checkAddr(addr); err != nil {
 		return false, err
 	}
-	// SDA was already set as pull-up.
-	if err := i.sda.In(gpio.PullUp, gpio.NoEdge); err != nil {
-		return false, err
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return i.probe(addr)
+}
+
+// Scan returns the 7-bit addresses of the devices that acknowledge a Probe.
+//
+// The reserved addresses 0x00 to 0x07 and 0x78 to 0x7F are skipped. See
+// table 3 in section 3.1.12 of UM10204.
+func (i *I2C) Scan() ([]uint16, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var found []uint16
+	for addr := uint16(0x08); addr <= 0x77; addr++ {
+		ok, err := i.probe(addr)
+		if err != nil {
+			return found, err
+		}
+		if ok {
+			found = append(found, addr)
+		}
 	}
-	// Implement clock stretching, the device may keep the line low.
-	for i.scl.Read() == gpio.Low {
-		i.sleepHalfCycle()
+	return found, nil
+}
+
+// SetWakePulse enables sending an empty START and STOP before each
+// transaction.
+//
+// Some devices, like the LC709203F, ignore the first transaction after
+// sleeping.
+func (i *I2C) SetWakePulse(wake bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.wake = wake
+}
+
+// SetLogger sets a function to trace each START, STOP, byte written or read
+// and its ACK or NACK.
+//
+// It immediately warns about a pin that reports not having its internal
+// pull-up enabled, as the bus then relies on external pull-ups.
+//
+// Use nil to disable tracing, which is the default.
+func (i *I2C) SetLogger(logf func(format string, args ...interface{})) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.logf = logf
+	if logf == nil {
+		return
 	}
-	// ACK == Low.
-	ack := i.sda.Read() == gpio.Low
-	if err := i.scl.Out(gpio.Low); err != nil {
-		return false, err
+	for _, p := range []gpio.PinIO{i.scl, i.sda} {
+		if pull := p.Pull(); pull != gpio.PullUp && pull != gpio.PullNoChange {
+			logf("bitbang-i2c: %s has no internal pull-up (%s); external pull-ups are required", p, pull)
+		}
 	}
-	if err := i.sda.Out(gpio.Low); err != nil {
-		return false, err
+}
+
+// SetSpeed implements i2c.Bus.
+//
+// It returns an error if f is not positive or above MaxSpeed, or if a
+// transaction is in progress.
+func (i *I2C) SetSpeed(f physic.Frequency) error {
+	if err := checkSpeed(f); err != nil {
+		return err
 	}
-	return ack, nil
+	if atomic.LoadInt32(&i.busy) != 0 {
+		return errors.New("bitbang-i2c: cannot change speed during a transaction")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.setSpeed(f)
+	atomic.StoreInt64(&i.period, int64(i.low+i.high))
+	return nil
 }
 
-// readByte reads 8 bits and an ACK.
+// Speed returns the configured speed, as set by New, SetSpeed or
+// SetClockTiming.
 //
-// Expects SDA and SCL low.
+// Use ActualSpeed for the speed that is effectively achieved.
+func (i *I2C) Speed() physic.Frequency {
+	return physic.PeriodToFrequency(time.Duration(atomic.LoadInt64(&i.period)))
+}
+
+// SetClockTiming sets the duration of the low and high periods of SCL.
 //
-// Ends with SDA low and SCL high.
+// The default is half of the period of the speed passed to New or SetSpeed.
+// UM10204 specifies separate minimums for both, for example 4.7µs low and 4µs
+// high in standard mode. See table 10 in section 6.1.
+func (i *I2C) SetClockTiming(low, high time.Duration) error {
+	if low <= 0 || high <= 0 {
+		return errors.New("bitbang-i2c: invalid clock timing")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.low = low
+	i.high = high
+	i.actualSpeed = 0
+	atomic.StoreInt64(&i.period, int64(low+high))
+	return nil
+}
+
+// SetStartStopTiming sets the START hold time, between SDA and SCL going low,
+// and the STOP setup time, between SCL and SDA going high.
 //
-// Lasts 9 cycles.
-func (i *I2C) readByte() (byte, error) {
-	var b byte
-	if err := i.sda.In(gpio.PullUp, gpio.NoEdge); err != nil {
-		return b, err
+// The default for both is half of the period of the speed passed to New or
+// SetSpeed. It returns an error if a duration is below the minimum specified
+// by UM10204 for the configured speed; see table 10 in section 6.1.
+func (i *I2C) SetStartStopTiming(hold, setup time.Duration) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	min := minStartStop(physic.PeriodToFrequency(i.low + i.high))
+	if hold < min || setup < min {
+		return fmt.Errorf("bitbang-i2c: START hold and STOP setup times must be at least %s", min)
 	}
-	for x := 0; x < 8; x++ {
-		i.sleepHalfCycle()
-		// TODO(maruel): Support clock stretching, the device may keep the line low.
-		_ = i.scl.Out(gpio.High)
-		i.sleepHalfCycle()
-		if i.sda.Read() == gpio.High {
-			b |= byte(1) << byte(7-x)
+	i.startHold = hold
+	i.stopSetup = setup
+	return nil
+}
+
+// ActualSpeed returns the clock frequency actually achieved, measured on the
+// first call.
+//
+// It is usually lower than the speed configured because of the overhead of
+// accessing the GPIOs and the sleep granularity. The measurement times the
+// delays of a byte transfer and reads of both lines, without driving them, so
+// it doesn't disturb the bus. It is measured again after the speed or the
+// clock timing is changed.
+func (i *I2C) ActualSpeed() physic.Frequency {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.actualSpeed == 0 {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		const cycles = 9
+		start := i.now()
+		for x := 0; x < cycles; x++ {
+			_ = i.sda.Read()
+			i.sleepLow()
+			_ = i.scl.Read()
+			i.sleepHigh()
 		}
-		_ = i.scl.Out(gpio.Low)
-	}
-	if err := i.sda.Out(gpio.Low); err != nil {
-		return 0, err
+		p := i.now().Sub(start) / cycles
+		if p <= 0 {
+			p = 1
+		}
+		i.actualSpeed = physic.PeriodToFrequency(p)
 	}
-	i.sleepHalfCycle()
-	_ = i.scl.Out(gpio.High)
-	i.sleepHalfCycle()
-	return b, nil
+	return i.actualSpeed
 }
 
-// sleep does a busy loop to act as fast as possible.
-func (i *I2C) sleepHalfCycle() {
-	cpu.Nanospin(i.halfCycle)
-}
+// Calibrate measures the shortest duration a sleep actually takes, and uses
+// it to decide between sleeping and busy looping for the delays of the bus.
+//
+// time.Sleep often sleeps much longer than asked, around 50µs on Linux, so by
+// default delays up to 100µs are busy looped and longer ones sleep, which can
+// still lower the speed achieved a lot. Once calibrated, delays shorter than
+// the granularity are busy looped, and longer ones sleep for the delay minus
+// the granularity then busy loop until the delay elapsed, so the half-cycle
+// measured matches the one configured as closely as possible. The measurement
+// is done once and kept; call it again after changing the CPU frequency
+// governor for example. ActualSpeed is measured again afterward.
+//
+// It returns the granularity measured.
+func (i *I2C) Calibrate() time.Duration {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	const samples = 10
+	g := time.Duration(0)
+	for x := 0; x < samples; x++ {
+		start := i.now()
+		i.sleepFn(time.Microsecond)
+		if d := i.now().Sub(start); x == 0 || d < g {
+			g = d
+		}
+	}
+	i.granularity = g
+	i.delay = i.calibratedSleep
+	i.actualSpeed = 0
+	return g
+}
+
+// SetDataSetupTime sets the duration SDA is stable before SCL rises while
+// writing, tSU;DAT. The default is DefaultDataSetupTime.
+//
+// It is part of the SCL low period, which is extended if d is longer. UM10204
+// requires at least 100ns in fast mode and 50ns in fast mode plus.
+func (i *I2C) SetDataSetupTime(d time.Duration) error {
+	if d < 0 {
+		return errors.New("bitbang-i2c: invalid data setup time")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.dataSetup = d
+	return nil
+}
+
+// SetReadSettle sets an extra delay between SCL reading high and SDA being
+// sampled while reading, so the slave has time to drive it. The default is 0.
+//
+// The SCL high period is extended by d. It helps at high speeds with fast
+// edges, where the delay from SetRiseTime is not needed but the GPIO latency
+// makes SDA be sampled too early. The speed achievable is bounded by the
+// latency of accessing the GPIOs, as each bit takes at least three accesses;
+// Fast-mode Plus is only reachable with memory mapped GPIOs. Use ActualSpeed
+// to measure it.
+func (i *I2C) SetReadSettle(d time.Duration) error {
+	if d < 0 {
+		return errors.New("bitbang-i2c: invalid read settle time")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.readSettle = d
+	return nil
+}
+
+// SetTransactionTimeout sets the maximum duration of a whole transaction.
+//
+// A transaction lasting longer is aborted like with TxContext and a context
+// with this timeout: it returns context.DeadlineExceeded after issuing a STOP
+// condition. It applies to every transaction, including the ones with a
+// context. The default is 0, which means no timeout.
+func (i *I2C) SetTransactionTimeout(d time.Duration) error {
+	if d < 0 {
+		return errors.New("bitbang-i2c: invalid transaction timeout")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.txTimeout = d
+	return nil
+}
+
+// SetClockStretchTimeout sets the maximum duration a slave may hold SCL low
+// before the transaction is aborted with ErrClockStretchTimeout.
+//
+// It applies to every clock, the data bits, the ACK, the repeated START and
+// the STOP condition. The lines are then released without a STOP condition.
+// The default is DefaultClockStretchTimeout.
+func (i *I2C) SetClockStretchTimeout(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stretchTimeout = d
+}
+
+// SetRealtime enables raising the priority of the OS thread during each
+// transaction, to reduce the clock jitter on a loaded system.
+//
+// It is only supported on linux and usually requires root or CAP_SYS_NICE;
+// otherwise the transactions run at the normal priority.
+func (i *I2C) SetRealtime(enable bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.realtime = enable
+}
+
+// SetBlind enables a timing-only mode where the lines are never read during
+// transactions.
+//
+// It is meant for pins that cannot sense the line, see ReadsBack. Every byte
+// written is assumed to be acknowledged, clock stretching, arbitration and
+// bus busy detection are disabled, and reading returns an error. Probe and
+// Scan report every address as present. Recover and CheckWiring still read
+// the lines.
+func (i *I2C) SetBlind(enable bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.blind = enable
+}
+
+// SetPushPullClock enables driving SCL high instead of releasing it to the
+// pull-up, which gives faster rising edges and allows higher speeds.
+//
+// Warning: it must only be used with a single master and with slaves that
+// never stretch the clock. Clock stretching is not supported in this mode and
+// another master or a slave holding SCL low would short the line. The default
+// is false.
+//
+// When SCL is a true open-drain output, it is switched to a push-pull output
+// with gpio.OUT, and back to gpio.OUT_OC when disabled.
+func (i *I2C) SetPushPullClock(enable bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if enable == i.pushPullClock {
+		return nil
+	}
+	if enable {
+		if i.sclOpenDrain {
+			if err := i.scl.(pin.PinFunc).SetFunc(gpio.OUT); err != nil {
+				return fmt.Errorf("bitbang-i2c: failed to set SCL as push-pull: %v", err)
+			}
+			i.sclOpenDrain = false
+		}
+	} else {
+		i.sclOpenDrain = setOpenDrain(i.scl)
+	}
+	i.pushPullClock = enable
+	if !enable && !i.closed {
+		// SCL was left driven high by the last transaction.
+		if err := i.releaseSCL(); err != nil {
+			return fmt.Errorf("bitbang-i2c: failed to release SCL: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetPersistentConfig enables configuring both pins again as released
+// open-drain lines at the start of each transaction.
+//
+// It is useful when something else may reconfigure the pins between
+// transactions, for example another process on a shared board. It is
+// disabled by default as it slows down every transaction.
+func (i *I2C) SetPersistentConfig(enable bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.persistent = enable
+}
+
+// SetACKTimeout sets the maximum duration to sample the ACK of each byte
+// written, from the time SCL is released for the 9th clock.
+//
+// When it expires because SCL is held low or because the samples of SDA do
+// not agree, the transaction fails with ErrACKTimeout. The clock stretch
+// timeout and the context passed to TxContext still apply. The default is 0,
+// which disables it.
+func (i *I2C) SetACKTimeout(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.ackTimeout = d
+}
+
+// SetNACKPolicy sets what happens when the slave doesn't acknowledge a byte
+// written. The default is NACKAbort.
+//
+// With NACKContinue, the bytes written are all clocked out even if some are
+// not acknowledged, which is useful for devices that don't acknowledge every
+// byte. The transaction then ends with a STOP condition, without reading, and
+// returns a *NACKsError. It doesn't apply to the address bytes, which still
+// abort the transaction.
+func (i *I2C) SetNACKPolicy(p NACKPolicy) error {
+	if p != NACKAbort && p != NACKContinue {
+		return fmt.Errorf("bitbang-i2c: invalid NACK policy %d", p)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.nackPolicy = p
+	return nil
+}
+
+// SetSampleVotes sets the number of times SDA is read when sampling an ACK or
+// a bit read, the level read the most times wins.
+//
+// It filters glitches on noisy lines. n must be odd; the default is 1.
+func (i *I2C) SetSampleVotes(n int) error {
+	if n < 1 || n%2 == 0 {
+		return errors.New("bitbang-i2c: the number of votes must be odd")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.votes = n
+	return nil
+}
+
+// SetRiseTime sets an extra delay to wait after each line is released to
+// high, before it is sampled or the next transition.
+//
+// It compensates for the RC rise time of the bus with weak pull-ups or high
+// capacitance. See UM10204 section 7.1. The default is 0.
+func (i *I2C) SetRiseTime(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.riseTime = d
+}
+
+// SetDiagnostics enables recording the timing of the lines during each
+// transaction, to help choosing the pull-up resistors. The default is
+// disabled.
+//
+// The recording of the last transaction is returned by LastDiagnostics.
+func (i *I2C) SetDiagnostics(enable bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.diagnostics = enable
+}
+
+// LastDiagnostics returns the timing recorded during the last transaction.
+//
+// It is zero if diagnostics are not enabled with SetDiagnostics.
+func (i *I2C) LastDiagnostics() Diagnostics {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.diag
+}
+
+// Recover releases a slave holding SDA low, for example because it was reset
+// in the middle of a transfer.
+//
+// It clocks SCL up to 9 times until SDA is released, then issues a STOP
+// condition. It returns an error if SDA is still held low.
+//
+// Each transaction already does it when SDA is low while SCL is high before
+// the START condition.
+func (i *I2C) Recover() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if i.closed {
+		return ErrClosed
+	}
+	return i.clearBus()
+}
+
+// CheckWiring does a quick sanity check of the wiring while the bus is idle.
+//
+// It verifies that both lines read high once released, then pulls each line
+// low in turn to verify the other one doesn't follow. A line stuck low
+// usually means SCL and SDA are swapped, a missing pull-up or a slave holding
+// the bus; two lines that follow each other are likely shorted.
+//
+// It doesn't detect that both lines are swapped on a working bus; Scan or
+// Probe don't find any device in this case.
+func (i *I2C) CheckWiring() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if i.closed {
+		return ErrClosed
+	}
+	i.release()
+	if !readsHigh(i.scl) {
+		return fmt.Errorf("bitbang-i2c: SCL %s reads low while idle; check that SCL and SDA are not swapped, the pull-ups and that no slave stretches the clock", i.scl)
+	}
+	if !readsHigh(i.sda) {
+		return fmt.Errorf("bitbang-i2c: SDA %s reads low while idle; check the pull-ups or try Recover", i.sda)
+	}
+	// Pulling one line low while the other is released must not affect it.
+	if err := i.scl.Out(gpio.Low); err != nil {
+		return err
+	}
+	i.settle()
+	follows := i.sda.Read() == gpio.Low
+	if err := i.releaseSCL(); err != nil {
+		return err
+	}
+	if !readsHigh(i.scl) {
+		return fmt.Errorf("bitbang-i2c: SCL %s stays low once released", i.scl)
+	}
+	if !follows {
+		// Slaves see a START then a STOP, which is harmless.
+		if err := i.sda.Out(gpio.Low); err != nil {
+			return err
+		}
+		i.settle()
+		follows = i.scl.Read() == gpio.Low
+		if err := i.releaseSDA(); err != nil {
+			return err
+		}
+		i.settle()
+	}
+	if follows {
+		return fmt.Errorf("bitbang-i2c: SCL %s and SDA %s follow each other; check that they are not shorted", i.scl, i.sda)
+	}
+	return nil
+}
+
+// SendStart issues a START condition.
+//
+// SendStart, SendByte, ReceiveByte and SendStop are low level primitives to
+// talk to devices that do not follow the usual framing. Use Tx otherwise.
+func (i *I2C) SendStart() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if i.closed {
+		return ErrClosed
+	}
+	return i.start()
+}
+
+// SendStop issues a STOP condition.
+func (i *I2C) SendStop() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if i.closed {
+		return ErrClosed
+	}
+	return i.stop()
+}
+
+// SendByte writes a byte and returns true if the slave acknowledged it.
+func (i *I2C) SendByte(b byte) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if i.closed {
+		return false, ErrClosed
+	}
+	return i.writeByte(b)
+}
+
+// ReceiveByte reads a byte, then acknowledges it if ack is true.
+func (i *I2C) ReceiveByte(ack bool) (byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if i.closed {
+		return 0, ErrClosed
+	}
+	return i.readByte(!ack)
+}
+
+// SendFrame issues a START, writes b then issues a STOP, without any
+// addressing.
+//
+// It is meant for devices that speak an I²C-like protocol without addresses,
+// like the TM1637 display controllers, which sample the ACK clock but may not
+// drive SDA. When expectAck is true, the ACK of each byte is checked and a
+// *NACKError is returned on the first byte not acknowledged. Bytes are sent
+// MSB first; for a device expecting LSB first, like the TM1637, reverse them
+// with bits.Reverse8 first.
+func (i *I2C) SendFrame(b []byte, expectAck bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return i.sendFrame(context.Background(), b, expectAck)
+}
+
+// ReadsBack returns false if a line didn't read high when New drove it high.
+//
+// It usually means the pin's Read doesn't sense the line, like on some output
+// only GPIO expanders, in which case the bus can only be used with SetBlind.
+// It can also be a device holding SDA low; see Recover.
+func (i *I2C) ReadsBack() bool {
+	return i.readsBack
+}
+
+// NeedsExternalPullups returns true if a line didn't read high when New
+// configured it as an input with pull-up.
+//
+// It usually means the pin has no internal pull-up and external resistors are
+// required, but it can also be a device holding SDA low; see Recover.
+func (i *I2C) NeedsExternalPullups() bool {
+	return i.needsPullups
+}
+
+// SCL implements i2c.Pins.
+func (i *I2C) SCL() gpio.PinIO {
+	return i.scl
+}
+
+// SDA implements i2c.Pins.
+func (i *I2C) SDA() gpio.PinIO {
+	return i.sda
+}
+
+// Pins returns SCL and SDA, in this order.
+//
+// It is useful to walk the pins of a resource generically. The slice is a copy
+// and can be modified by the caller.
+func (i *I2C) Pins() []gpio.PinIO {
+	return []gpio.PinIO{i.scl, i.sda}
+}
+
+//
+
+// tx does a transaction.
+//
+// A repeated START is issued between w and r when both are not empty. When
+// repeated is true, it is issued even if w is empty.
+func (i *I2C) tx(ctx context.Context, addr uint16, w, r []byte, repeated bool) (err error) {
+	defer zeroOnError(&err, r)
+	if err := i.checkAddr(addr); err != nil {
+		return err
+	}
+	if len(w) == 0 && len(r) == 0 && (w != nil || r != nil) {
+		return errors.New("bitbang-i2c: empty transfer; use nil buffers to probe")
+	}
+	if err := i.begin(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := i.end(err); err == nil {
+			err = err2
+		}
+	}()
+	tenBits := addr != SkipAddr && addr > 0x7F
+	if addr != SkipAddr {
+		read := !tenBits && !repeated && len(w) == 0 && len(r) != 0
+		if err := i.writeAddr(addr, read, "address"); err != nil {
+			return err
+		}
+	}
+	if err := i.writeBytes(w, 0); err != nil {
+		return err
+	}
+	if len(r) != 0 && (len(w) != 0 || tenBits || repeated) {
+		if err := i.restart(); err != nil {
+			return err
+		}
+		if addr != SkipAddr {
+			if err := i.writeAddr(addr, true, "read-restart"); err != nil {
+				return err
+			}
+		}
+	}
+	return i.readBytes(r, true)
+}
+
+// sequence does a transaction made of multiple operations, separated by
+// repeated STARTs.
+func (i *I2C) sequence(ctx context.Context, addr uint16, ops []Op) (err error) {
+	defer func() {
+		for _, op := range ops {
+			if op.Read {
+				zeroOnError(&err, op.Buf)
+			}
+		}
+	}()
+	if err := i.checkAddr(addr); err != nil {
+		return err
+	}
+	if err := i.begin(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := i.end(err); err == nil {
+			err = err2
+		}
+	}()
+	for x, op := range ops {
+		if x != 0 {
+			if err := i.restart(); err != nil {
+				return err
+			}
+		}
+		if addr != SkipAddr {
+			if x == 0 && op.Read && addr > 0x7F {
+				// Page 16, figure 15. A 10-bit slave must first be addressed for
+				// writing.
+				if err := i.writeAddr(addr, false, "address"); err != nil {
+					return err
+				}
+				if err := i.restart(); err != nil {
+					return err
+				}
+			}
+			if err := i.writeAddr(addr, op.Read, "address"); err != nil {
+				return err
+			}
+		}
+		if op.Read {
+			err = i.readBytes(op.Buf, true)
+		} else {
+			err = i.writeBytes(op.Buf, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stream does a transaction writing multiple chunks.
+func (i *I2C) stream(ctx context.Context, addr uint16, chunks [][]byte, r []byte) (err error) {
+	defer zeroOnError(&err, r)
+	if err := i.checkAddr(addr); err != nil {
+		return err
+	}
+	n := 0
+	for _, c := range chunks {
+		n += len(c)
+	}
+	if n == 0 {
+		return errors.New("bitbang-i2c: nothing to write; use Tx")
+	}
+	if err := i.begin(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := i.end(err); err == nil {
+			err = err2
+		}
+	}()
+	if addr != SkipAddr {
+		if err := i.writeAddr(addr, false, "address"); err != nil {
+			return err
+		}
+	}
+	n = 0
+	for _, c := range chunks {
+		if err := i.writeBytes(c, n); err != nil {
+			return err
+		}
+		n += len(c)
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	if err := i.restart(); err != nil {
+		return err
+	}
+	if addr != SkipAddr {
+		if err := i.writeAddr(addr, true, "read-restart"); err != nil {
+			return err
+		}
+	}
+	return i.readBytes(r, true)
+}
+
+// readStream does a transaction reading r in chunks.
+func (i *I2C) readStream(ctx context.Context, addr uint16, w, r []byte, chunk int) (err error) {
+	defer zeroOnError(&err, r)
+	if err := i.checkAddr(addr); err != nil {
+		return err
+	}
+	if len(r) == 0 {
+		return errors.New("bitbang-i2c: nothing to read; use Tx")
+	}
+	if err := i.begin(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := i.end(err); err == nil {
+			err = err2
+		}
+	}()
+	if addr != SkipAddr {
+		if err := i.writeAddr(addr, false, "address"); err != nil {
+			return err
+		}
+	}
+	if err := i.writeBytes(w, 0); err != nil {
+		return err
+	}
+	if err := i.restart(); err != nil {
+		return err
+	}
+	if addr != SkipAddr {
+		if err := i.writeAddr(addr, true, "read-restart"); err != nil {
+			return err
+		}
+	}
+	for len(r) > chunk {
+		if err := i.readBytes(r[:chunk], false); err != nil {
+			return err
+		}
+		r = r[chunk:]
+		runtime.Gosched()
+	}
+	return i.readBytes(r, true)
+}
+
+// sendFrame does a transaction writing b without address.
+func (i *I2C) sendFrame(ctx context.Context, b []byte, expectAck bool) (err error) {
+	if len(b) == 0 {
+		return errors.New("bitbang-i2c: nothing to write")
+	}
+	if err := i.begin(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := i.end(err); err == nil {
+			err = err2
+		}
+	}()
+	if expectAck {
+		return i.writeBytes(b, 0)
+	}
+	for _, v := range b {
+		if err := i.aborted(); err != nil {
+			return err
+		}
+		if _, err := i.writeByte(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroOnError zeroes r if *err is set, so a caller ignoring the error doesn't
+// use the bytes read before the failure.
+func zeroOnError(err *error, r []byte) {
+	if *err != nil {
+		for x := range r {
+			r[x] = 0
+		}
+	}
+}
+
+// checkAddr returns an error if addr is not a valid address.
+//
+// 10-bit addresses are not checked for reservation.
+func (i *I2C) checkAddr(addr uint16) error {
+	if addr == SkipAddr {
+		return nil
+	}
+	if addr > 0x3FF {
+		return errors.New("bitbang-i2c: invalid address")
+	}
+	if !i.allowReserved && (addr < 0x08 || (addr >= 0x78 && addr <= 0x7F)) {
+		return fmt.Errorf("bitbang-i2c: reserved address 0x%02X; see SetAllowReservedAddresses", addr)
+	}
+	return nil
+}
+
+// probe addresses the device addr for writing while the bus lock is held.
+func (i *I2C) probe(addr uint16) (ack bool, err error) {
+	if err := i.begin(context.Background()); err != nil {
+		return false, err
+	}
+	defer func() {
+		if err2 := i.end(err); err == nil {
+			err = err2
+		}
+	}()
+	if err := i.writeAddr(addr, false, "address"); err != nil {
+		if _, ok := err.(*NACKError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// clearBus clocks SCL until SDA is released then issues a STOP condition.
+func (i *I2C) clearBus() error {
+	// Page 20, section 3.1.16 Bus clear
+	if err := i.releaseSDA(); err != nil {
+		return err
+	}
+	i.settle()
+	for x := 0; x < 9 && i.sda.Read() == gpio.Low; x++ {
+		if err := i.scl.Out(gpio.Low); err != nil {
+			return err
+		}
+		i.sleepLow()
+		if err := i.releaseSCL(); err != nil {
+			return err
+		}
+		if err := i.waitSCL(); err != nil {
+			return err
+		}
+		i.settle()
+		i.sleepHigh()
+	}
+	if i.sda.Read() == gpio.Low {
+		return errors.New("bitbang-i2c: SDA is stuck low")
+	}
+	if err := i.scl.Out(gpio.Low); err != nil {
+		return err
+	}
+	if err := i.sda.Out(gpio.Low); err != nil {
+		return err
+	}
+	return i.stop()
+}
+
+// aborted returns an error if the transaction shall be aborted.
+func (i *I2C) aborted() error {
+	if atomic.LoadInt32(&i.halt) != 0 {
+		return ErrHalted
+	}
+	return i.ctx.Err()
+}
+
+// begin starts a transaction by issuing a START condition.
+//
+// end must be called if it succeeds.
+func (i *I2C) begin(ctx context.Context) error {
+	if i.closed {
+		return ErrClosed
+	}
+	i.diag = Diagnostics{}
+	if i.persistent {
+		if err := i.reconfigure(); err != nil {
+			return err
+		}
+	}
+	if !i.blind {
+		// Page 11, section 3.1.8 Arbitration
+		// Another master may be using the bus.
+		if i.scl.Read() == gpio.Low {
+			return ErrBusBusy
+		}
+		// A slave may still hold SDA from an aborted transaction.
+		if i.sda.Read() == gpio.Low {
+			if i.logf != nil {
+				i.logf("bitbang-i2c: SDA is held low, clearing the bus")
+			}
+			if err := i.clearBus(); err != nil {
+				if i.sda.Read() == gpio.Low {
+					return ErrBusBusy
+				}
+				return err
+			}
+		}
+	}
+	atomic.StoreInt32(&i.busy, 1)
+	if i.txTimeout > 0 {
+		ctx, i.cancel = context.WithTimeout(ctx, i.txTimeout)
+	}
+	i.ctx = ctx
+	if i.realtime {
+		// It's best effort; it usually requires CAP_SYS_NICE.
+		restore, err := raisePriority()
+		if err != nil && i.logf != nil {
+			i.logf("bitbang-i2c: failed to raise the thread priority: %v", err)
+		}
+		i.restorePriority = restore
+	}
+	var err error
+	if i.wake {
+		if err = i.start(); err == nil {
+			err = i.stop()
+		}
+	}
+	if err == nil {
+		err = i.start()
+	}
+	if err != nil {
+		// Try to leave the bus idle anyway.
+		_ = i.end(err)
+		return err
+	}
+	return nil
+}
+
+// end ends a transaction started with begin by issuing a STOP condition.
+//
+// err is the error of the transaction, if any. It returns the error of the
+// STOP condition.
+func (i *I2C) end(err error) error {
+	defer func() {
+		if i.restorePriority != nil {
+			i.restorePriority()
+			i.restorePriority = nil
+		}
+		if i.cancel != nil {
+			i.cancel()
+			i.cancel = nil
+		}
+		i.ctx = context.Background()
+		atomic.StoreInt32(&i.busy, 0)
+	}()
+	switch err {
+	case ErrArbitrationLost:
+		// The other master owns the bus now, do not issue a STOP.
+		i.release()
+		return nil
+	case ErrClockStretchTimeout, ErrACKTimeout:
+		// A STOP can't be issued while SCL is held low, and waiting for it
+		// again would double the timeout.
+		i.release()
+		return nil
+	}
+	return i.stop()
+}
+
+// writeAddr writes the address with the R/W bit.
+//
+// 10-bit addresses are written as two bytes, except for a read where only the
+// first byte is written, as the slave must have been addressed for writing
+// before the repeated START.
+func (i *I2C) writeAddr(addr uint16, read bool, phase string) error {
+	rw := uint16(0)
+	if read {
+		rw = 1
+	}
+	if addr <= 0x7F {
+		// Page 13, section 3.1.10 The slave address and R/W bit
+		return i.writeAcked(byte(addr<<1|rw), phase, 0)
+	}
+	// Page 15, section 3.1.11 10-bit addressing
+	// The first byte is 0b11110xx0 where xx are the two most significant bits
+	// of the address, followed by the lower 8 bits.
+	if err := i.writeAcked(byte(0xF0|(addr>>7)&0x06|rw), phase, 0); err != nil {
+		return err
+	}
+	if read {
+		return nil
+	}
+	return i.writeAcked(byte(addr), phase, 1)
+}
+
+// writeBytes writes w, checking the transaction context between bytes.
+//
+// index is the index of w[0] reported in a *NACKError.
+//
+// With NACKContinue, the bytes not acknowledged are returned in a
+// *NACKsError once all of w is written.
+func (i *I2C) writeBytes(w []byte, index int) error {
+	var nacks []NACKError
+	for x, b := range w {
+		if err := i.aborted(); err != nil {
+			return err
+		}
+		if err := i.writeAcked(b, "write", index+x); err != nil {
+			n, ok := err.(*NACKError)
+			if !ok || i.nackPolicy != NACKContinue {
+				return err
+			}
+			nacks = append(nacks, *n)
+		}
+	}
+	if len(nacks) != 0 {
+		return &NACKsError{NACKs: nacks}
+	}
+	return nil
+}
+
+// readBytes reads into r, checking the transaction context between bytes.
+//
+// When last is true, the last byte is NACK'ed to signal the slave the end of
+// the read.
+func (i *I2C) readBytes(r []byte, last bool) error {
+	for x := range r {
+		if err := i.aborted(); err != nil {
+			return err
+		}
+		var err error
+		if r[x], err = i.readByte(last && x == len(r)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// "When CLK is a high level and DIO changes from high to low level, data input
+// starts."
+//
+// Ends with SDA and SCL low.
+//
+// Lasts 1/2 cycle, plus what remains of the bus free time after the last STOP
+// condition, if any.
+func (i *I2C) start() error {
+	if !i.lastStop.IsZero() {
+		// tBUF
+		if d := minBusFree(physic.PeriodToFrequency(i.low+i.high)) - i.now().Sub(i.lastStop); d > 0 {
+			i.delay(d)
+		}
+		i.lastStop = time.Time{}
+	}
+	// Page 9, section 3.1.4 START and STOP conditions
+	if err := i.sda.Out(gpio.Low); err != nil {
+		return err
+	}
+	// tHD;STA
+	i.delay(i.startHold)
+	if err := i.scl.Out(gpio.Low); err != nil {
+		return err
+	}
+	if i.logf != nil {
+		i.logf("bitbang-i2c: START")
+	}
+	return nil
+}
+
+// restart issues a repeated START condition.
+//
+// Expects SCL low.
+//
+// Ends with SDA and SCL low.
+//
+// Lasts 3/2 cycle.
+func (i *I2C) restart() error {
+	// Page 9, section 3.1.4 START and STOP conditions
+	// "The START (S) and repeated START (Sr) conditions are functionally
+	// identical."
+	if err := i.releaseSDA(); err != nil {
+		return err
+	}
+	i.settle()
+	i.sleepLow()
+	if err := i.releaseSCL(); err != nil {
+		return err
+	}
+	if err := i.waitSCL(); err != nil {
+		return err
+	}
+	i.settle()
+	i.sleepHigh()
+	return i.start()
+}
+
+// "When CLK is a high level and DIO changes from low level to high level, data
+// input ends."
+//
+// Lasts 1 cycle. The bus free time is waited for by the next START.
+func (i *I2C) stop() error {
+	// Page 9, section 3.1.4 START and STOP conditions
+	if err := i.scl.Out(gpio.Low); err != nil {
+		return err
+	}
+	i.sleepLow()
+	if err := i.releaseSCL(); err != nil {
+		return err
+	}
+	if err := i.waitSCL(); err != nil {
+		// Don't keep SDA low, which would leave the bus busy for the other
+		// masters.
+		i.release()
+		return err
+	}
+	i.settle()
+	// tSU;STO
+	i.delay(i.stopSetup)
+	if err := i.releaseSDA(); err != nil {
+		return err
+	}
+	i.settle()
+	i.lastStop = i.now()
+	if i.logf != nil {
+		i.logf("bitbang-i2c: STOP")
+	}
+	return nil
+}
+
+// release releases both lines.
+func (i *I2C) release() {
+	_ = i.releaseSDA()
+	_ = i.releaseSCL()
+	i.settle()
+}
+
+// reconfigure configures both pins again as released lines, like New does.
+func (i *I2C) reconfigure() error {
+	if i.sclOpenDrain {
+		i.sclOpenDrain = setOpenDrain(i.scl)
+	}
+	if i.sdaOpenDrain {
+		i.sdaOpenDrain = setOpenDrain(i.sda)
+	}
+	if err := i.releaseSCL(); err != nil {
+		return err
+	}
+	if err := i.releaseSDA(); err != nil {
+		return err
+	}
+	i.settle()
+	return nil
+}
+
+// releaseSCL releases SCL so it is pulled high unless a slave holds it low.
+//
+// It drives SCL high instead with SetPushPullClock, which is the only case
+// where a line is driven high.
+func (i *I2C) releaseSCL() error {
+	if i.pushPullClock {
+		return i.scl.Out(gpio.High)
+	}
+	if i.sclOpenDrain {
+		// Floats the line.
+		return i.scl.Out(gpio.High)
+	}
+	return i.scl.In(gpio.PullUp, gpio.NoEdge)
+}
+
+// releaseSDA releases SDA so it is pulled high unless a slave holds it low.
+func (i *I2C) releaseSDA() error {
+	if i.sdaOpenDrain {
+		return i.sda.Out(gpio.High)
+	}
+	return i.sda.In(gpio.PullUp, gpio.NoEdge)
+}
+
+// writeByte writes 8 bits then waits for ACK.
+//
+// Expects SDA and SCL low.
+//
+// Ends with SDA and SCL low.
+//
+// Lasts 9 cycles.
+func (i *I2C) writeByte(b byte) (bool, error) {
+	// Page 9, section 3.1.3 Data validity
+	// "The data on te SDA line must be stable during the high period of the
+	// clock."
+	// Page 10, section 3.1.5 Byte format
+	// MSBFirst: bit 7 is on the first clock.
+	for mask := byte(0x80); mask != 0; mask >>= 1 {
+		bit := gpio.Level(b&mask != 0)
+		// Page 48, table 10: only tSU;DAT before the rising edge of SCL
+		// matters; the data hold time is 0.
+		i.sleepDataHold()
+		// A 1 bit releases SDA instead of driving it, so that another master
+		// pulling it low wins the arbitration instead of shorting the line.
+		if bit == gpio.High {
+			if err := i.releaseSDA(); err != nil {
+				return false, err
+			}
+			i.settle()
+		} else if err := i.sda.Out(gpio.Low); err != nil {
+			return false, err
+		}
+		i.delay(i.dataSetup)
+		// Let the device read SDA; it may stretch the clock.
+		if err := i.releaseSCL(); err != nil {
+			return false, err
+		}
+		if err := i.waitSCL(); err != nil {
+			return false, err
+		}
+		i.settle()
+		i.sleepHigh()
+		// Page 11, section 3.1.8 Arbitration
+		// Another master is driving SDA low.
+		if bit == gpio.High && !i.blind && i.sda.Read() == gpio.Low {
+			return false, ErrArbitrationLost
+		}
+		if err := i.scl.Out(gpio.Low); err != nil {
+			return false, err
+		}
+	}
+	// Page 10, section 3.1.6 ACK and NACK
+	// 9th clock is ACK. SDA is released while SCL is still low so that it is
+	// stable before SCL goes high, and it is only sampled during the high
+	// period.
+	// SDA was already set as pull-up.
+	if err := i.releaseSDA(); err != nil {
+		return false, err
+	}
+	i.settle()
+	i.sleepLow()
+	var deadline time.Time
+	if i.ackTimeout > 0 {
+		deadline = i.now().Add(i.ackTimeout)
+	}
+	// SCL was already set as pull-up. PullNoChange
+	if err := i.releaseSCL(); err != nil {
+		return false, err
+	}
+	if err := i.waitSCLUntil(deadline); err != nil {
+		return false, err
+	}
+	i.settle()
+	i.sleepHigh()
+	// ACK == Low.
+	ack := true
+	if !i.blind {
+		l, sure := i.voteSDA()
+		for !sure && !deadline.IsZero() {
+			if i.now().After(deadline) {
+				return false, ErrACKTimeout
+			}
+			l, sure = i.voteSDA()
+		}
+		ack = l == gpio.Low
+	}
+	if err := i.scl.Out(gpio.Low); err != nil {
+		return false, err
+	}
+	if err := i.sda.Out(gpio.Low); err != nil {
+		return false, err
+	}
+	if i.logf != nil {
+		i.logf("bitbang-i2c: write 0x%02X %s", b, ackStr(ack))
+	}
+	return ack, nil
+}
+
+// writeAcked writes a byte and returns a *NACKError on NACK.
+func (i *I2C) writeAcked(b byte, phase string, index int) error {
+	ack, err := i.writeByte(b)
+	if err != nil {
+		return err
+	}
+	if !ack {
+		return &NACKError{Phase: phase, Index: index, Value: b}
+	}
+	return nil
+}
+
+// readByte reads 8 bits and sends an ACK, or a NACK if last is true.
+//
+// Page 10, section 3.1.6 ACK and NACK
+// "A NACK is generated when the master-receiver signals the end of the
+// transfer to the slave-transmitter."
+//
+// Expects SDA and SCL low.
+//
+// Ends with SDA and SCL low.
+//
+// Lasts 9 cycles.
+func (i *I2C) readByte(last bool) (byte, error) {
+	b, err := i.readBits()
+	if err != nil {
+		return 0, err
+	}
+	return b, i.sendACK(b, !last)
+}
+
+// readBits reads the 8 bits of a byte, leaving the 9th clock for sendACK.
+//
+// Expects SDA and SCL low.
+//
+// Ends with SCL low and SDA released.
+//
+// Lasts 8 cycles.
+func (i *I2C) readBits() (byte, error) {
+	var b byte
+	if i.blind {
+		return b, errors.New("bitbang-i2c: cannot read in blind mode")
+	}
+	if err := i.releaseSDA(); err != nil {
+		return b, err
+	}
+	i.settle()
+	// MSBFirst: bit 7 is on the first clock.
+	for mask := byte(0x80); mask != 0; mask >>= 1 {
+		i.sleepLow()
+		// Release SCL and only sample SDA once it actually reads high.
+		if err := i.releaseSCL(); err != nil {
+			return 0, err
+		}
+		if err := i.waitSCL(); err != nil {
+			return 0, err
+		}
+		i.settle()
+		i.sleepHigh()
+		if i.readSettle > 0 {
+			i.delay(i.readSettle)
+		}
+		if i.sampleSDA() == gpio.High {
+			b |= mask
+		}
+		if err := i.scl.Out(gpio.Low); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// sendACK sends an ACK, or a NACK if ack is false, for the byte b read with
+// readBits.
+//
+// Expects SCL low and SDA released.
+//
+// Ends with SDA and SCL low.
+//
+// Lasts 1 cycle.
+func (i *I2C) sendACK(b byte, ack bool) error {
+	if ack {
+		if err := i.sda.Out(gpio.Low); err != nil {
+			return err
+		}
+	}
+	i.sleepLow()
+	if err := i.releaseSCL(); err != nil {
+		return err
+	}
+	if err := i.waitSCL(); err != nil {
+		return err
+	}
+	i.settle()
+	i.sleepHigh()
+	if err := i.scl.Out(gpio.Low); err != nil {
+		return err
+	}
+	if !ack {
+		if err := i.sda.Out(gpio.Low); err != nil {
+			return err
+		}
+	}
+	if i.logf != nil {
+		i.logf("bitbang-i2c: read 0x%02X %s", b, ackStr(ack))
+	}
+	return nil
+}
+
+// waitSCL waits for SCL to be released.
+//
+// Implements clock stretching, the device may keep the line low.
+func (i *I2C) waitSCL() error {
+	return i.waitSCLUntil(time.Time{})
+}
+
+// waitSCLUntil is like waitSCL but returns ErrACKTimeout once ack is reached,
+// if it is not zero.
+func (i *I2C) waitSCLUntil(ack time.Time) error {
+	if i.blind || i.pushPullClock || i.scl.Read() == gpio.High {
+		return nil
+	}
+	deadline := i.now().Add(i.stretchTimeout)
+	cycles := 0
+	for i.scl.Read() == gpio.Low {
+		now := i.now()
+		if !ack.IsZero() && now.After(ack) {
+			return ErrACKTimeout
+		}
+		if now.After(deadline) {
+			return ErrClockStretchTimeout
+		}
+		if err := i.aborted(); err != nil {
+			return err
+		}
+		i.sleepHalfCycle()
+		cycles++
+		if i.diagnostics {
+			i.diag.StretchCycles++
+		}
+	}
+	if i.diagnostics && cycles == 0 {
+		// SCL was still rising on the first read.
+		i.diag.RiseTimeNeeded = true
+	}
+	return nil
+}
+
+// sampleSDA reads SDA as many times as configured with SetSampleVotes and
+// returns the majority.
+func (i *I2C) sampleSDA() gpio.Level {
+	l, _ := i.voteSDA()
+	return l
+}
+
+// voteSDA is like sampleSDA but also returns true if all the reads agreed.
+func (i *I2C) voteSDA() (gpio.Level, bool) {
+	high := 0
+	for x := 0; x < i.votes; x++ {
+		if i.sda.Read() == gpio.High {
+			high++
+		}
+	}
+	return gpio.Level(2*high > i.votes), high == 0 || high == i.votes
+}
+
+// sleepHalfCycle waits for half a clock cycle.
+func (i *I2C) sleepHalfCycle() {
+	i.delay(i.halfCycle)
+}
+
+// sleepLow waits for the SCL low period.
+func (i *I2C) sleepLow() {
+	i.delay(i.low)
+}
+
+// sleepDataHold waits for the part of the SCL low period before SDA is
+// changed, so that SDA is stable for the data setup time before SCL rises.
+func (i *I2C) sleepDataHold() {
+	if d := i.low - i.dataSetup; d > 0 {
+		i.delay(d)
+	}
+}
+
+// sleepHigh waits for the SCL high period.
+func (i *I2C) sleepHigh() {
+	i.delay(i.high)
+}
+
+// settle waits for the rise time set with SetRiseTime after a line was
+// released.
+func (i *I2C) settle() {
+	if i.riseTime > 0 {
+		i.delay(i.riseTime)
+	}
+}
+
+// sleep waits for d.
+//
+// It does a busy loop to act as fast as possible, unless d is long enough for
+// time.Sleep to be precise enough.
+func sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	if d > maxSpin {
+		time.Sleep(d)
+		return
+	}
+	cpu.Nanospin(d)
+}
+
+// calibratedSleep waits for d using the granularity measured by Calibrate.
+func (i *I2C) calibratedSleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	if d <= i.granularity {
+		i.spin(d)
+		return
+	}
+	end := i.now().Add(d)
+	i.sleepFn(d - i.granularity)
+	if r := end.Sub(i.now()); r > 0 {
+		i.spin(r)
+	}
+}
+
+// setOpenDrain configures p as a true open-drain output if supported.
+//
+// A pin supports it when it implements pin.PinFunc and lists gpio.OUT_OC in
+// its supported functions; Out(gpio.High) then floats the line. It returns
+// false if the emulation, switching the pin between input with pull-up and
+// output low, must be used instead.
+func setOpenDrain(p gpio.PinIO) bool {
+	f, ok := p.(pin.PinFunc)
+	if !ok {
+		return false
+	}
+	for _, s := range f.SupportedFuncs() {
+		if s == gpio.OUT_OC {
+			return f.SetFunc(gpio.OUT_OC) == nil
+		}
+	}
+	return false
+}
+
+// setSpeed sets the timings for the speed f.
+func (i *I2C) setSpeed(f physic.Frequency) {
+	i.halfCycle = f.Period() / 2
+	i.low = i.halfCycle
+	i.high = i.halfCycle
+	// Half a period is above the minimum tHD;STA and tSU;STO of every mode;
+	// see minStartStop.
+	i.startHold = i.halfCycle
+	i.stopSetup = i.halfCycle
+	i.actualSpeed = 0
+}
+
+// minStartStop returns the minimum tHD;STA and tSU;STO for the speed f.
+//
+// Table 10 in section 6.1 of UM10204: 4µs in standard mode, 0.6µs in fast
+// mode and 0.26µs in fast mode plus.
+func minStartStop(f physic.Frequency) time.Duration {
+	switch {
+	case f <= 100*physic.KiloHertz:
+		return 4 * time.Microsecond
+	case f <= 400*physic.KiloHertz:
+		return 600 * time.Nanosecond
+	default:
+		return 260 * time.Nanosecond
+	}
+}
+
+// minBusFree returns the minimum tBUF, between a STOP and a START condition,
+// for the speed f.
+//
+// Table 10 in section 6.1 of UM10204: 4.7µs in standard mode, 1.3µs in fast
+// mode and 0.5µs in fast mode plus.
+func minBusFree(f physic.Frequency) time.Duration {
+	switch {
+	case f <= 100*physic.KiloHertz:
+		return 4700 * time.Nanosecond
+	case f <= 400*physic.KiloHertz:
+		return 1300 * time.Nanosecond
+	default:
+		return 500 * time.Nanosecond
+	}
+}
+
+// busKey identifies the pins of a bus.
+type busKey struct {
+	scl, sda gpio.PinIO
+}
+
+// newBusKey returns the busKey of the pins clk and data.
+//
+// Aliases are resolved to the real pins, since gpioreg.ByName returns a new
+// alias on each call.
+func newBusKey(clk, data gpio.PinIO) busKey {
+	return busKey{realPin(clk), realPin(data)}
+}
+
+// realPin returns the pin behind the alias p, or p if it is not an alias.
+func realPin(p gpio.PinIO) gpio.PinIO {
+	for {
+		r, ok := p.(gpio.RealPin)
+		if !ok {
+			return p
+		}
+		p = r.Real()
+	}
+}
+
+var (
+	busesMu sync.Mutex
+	// buses are the buses opened by New that are not closed yet.
+	buses = map[busKey]*I2C{}
+)
+
+// sharedBus returns the bus already opened on the pins of key with one more
+// reference, or nil if there is none.
+//
+// busesMu must be held.
+func sharedBus(key busKey, f physic.Frequency) (*I2C, error) {
+	clk, data := key.scl, key.sda
+	for k, i := range buses {
+		if k.scl == clk && k.sda == data {
+			i.mu.Lock()
+			defer i.mu.Unlock()
+			if i.halfCycle != f.Period()/2 {
+				return nil, fmt.Errorf("bitbang-i2c: bus on %s and %s is already open at another speed; use SetSpeed", clk, data)
+			}
+			i.refs++
+			return i, nil
+		}
+		if k.scl == clk || k.scl == data || k.sda == clk || k.sda == data {
+			return nil, fmt.Errorf("bitbang-i2c: pins already used by the bus on %s and %s", k.scl, k.sda)
+		}
+	}
+	return nil, nil
+}
+
+// isComparable returns true if p can be used as a map key.
+func isComparable(p gpio.PinIO) bool {
+	return reflect.TypeOf(p).Comparable()
+}
+
+// pullUpTimeout is how long New waits for a line to rise.
+const pullUpTimeout = time.Millisecond
+
+// readsHigh returns true if p reads high within pullUpTimeout.
+func readsHigh(p gpio.PinIO) bool {
+	deadline := time.Now().Add(pullUpTimeout)
+	for p.Read() == gpio.Low {
+		if time.Now().After(deadline) {
+			return false
+		}
+		cpu.Nanospin(time.Microsecond)
+	}
+	return true
+}
+
+// isRetryable returns true if the transaction failed because of an error
+// that may be transient.
+func isRetryable(err error) bool {
+	switch err.(type) {
+	case *NACKError, *NACKsError:
+		return true
+	}
+	return err == ErrArbitrationLost
+}
+
+// ackStr returns "ACK" or "NACK" for logging.
+func ackStr(ack bool) string {
+	if ack {
+		return "ACK"
+	}
+	return "NACK"
+}
+
+// checkSpeed returns an error if f is not a supported speed.
+func checkSpeed(f physic.Frequency) error {
+	if f <= 0 {
+		return errors.New("bitbang-i2c: invalid speed")
+	}
+	if f > MaxSpeed {
+		return fmt.Errorf("bitbang-i2c: speed %s is above %s", f, MaxSpeed)
+	}
+	return nil
+}
+
+// maxSpin is the longest duration to busy loop for.
+const maxSpin = 100 * time.Microsecond
 
+var _ conn.Resource = &I2C{}
 var _ i2c.Bus = &I2C{}
+var _ i2c.BusCloser = &I2C{}
+var _ i2c.Pins = &I2C{}
@@ -0,0 +1,3121 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpioreg"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2creg"
+	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/conn/pin"
+)
+
+func TestNew_BusCloser(t *testing.T) {
+	var b interface{} = newFakeI2C(t, &fakeWire{})
+	c, ok := b.(i2c.BusCloser)
+	if !ok {
+		t.Fatal("expected i2c.BusCloser")
+	}
+	if _, ok := c.(i2c.Pins); !ok {
+		t.Fatal("expected i2c.Pins")
+	}
+	if s := c.String(); s != "bitbang/i2c(SCL, SDA)@1MHz" {
+		t.Fatal(s)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteByte_ACK(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	i.start()
+	b.reset()
+	ack, err := i.writeByte(0xA5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ack {
+		t.Fatal("expected ACK")
+	}
+	// 0xA5 = 0b10100101; the slave pulls SDA low right after the 8th falling
+	// edge, so SDA stays low for the 9th clock.
+	expected := []string{
+		"D1", "C1", "C0",
+		"D0", "C1", "C0",
+		"D1", "C1", "C0",
+		"D0", "C1", "C0",
+		"C1", "C0",
+		"D1", "C1", "C0",
+		"D0", "C1", "C0",
+		"D1", "C1", "C0",
+		"D0",
+		"C1", "C0",
+		"D1", "D0",
+	}
+	if !reflect.DeepEqual(b.trace, expected) {
+		t.Fatalf("unexpected trace\n%v\n%v", b.trace, expected)
+	}
+	if !reflect.DeepEqual(b.slave.frames, [][]byte{{0xA5}}) {
+		t.Fatal(b.slave.frames)
+	}
+}
+
+func TestWriteByte_NACK(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func([]byte) bool { return true }}}
+	i := newFakeI2C(t, b)
+	i.start()
+	b.reset()
+	ack, err := i.writeByte(0x80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack {
+		t.Fatal("expected NACK")
+	}
+	// SDA must be released while SCL is low, otherwise a STOP condition is
+	// generated in the middle of the byte.
+	expected := []string{
+		"D1", "C1", "C0",
+		"D0", "C1", "C0",
+		"C1", "C0",
+		"C1", "C0",
+		"C1", "C0",
+		"C1", "C0",
+		"C1", "C0",
+		"C1", "C0",
+		"D1", "C1", "C0",
+		"D0",
+	}
+	if !reflect.DeepEqual(b.trace, expected) {
+		t.Fatalf("unexpected trace\n%v\n%v", b.trace, expected)
+	}
+	if b.slave.stops != 0 {
+		t.Fatal("unexpected STOP condition")
+	}
+}
+
+func TestTx_RWBit(t *testing.T) {
+	data := []struct {
+		name     string
+		w        []byte
+		n        int
+		expected [][]byte
+	}{
+		{"empty w", nil, 1, [][]byte{{0x10<<1 | 1}}},
+		{"empty r", []byte{0x01}, 0, [][]byte{{0x10 << 1, 0x01}}},
+		{"both nil", nil, 0, [][]byte{{0x10 << 1}}},
+	}
+	for _, line := range data {
+		b := &fakeWire{slave: &fakeSlave{tx: []byte{0x42}}}
+		i := newFakeI2C(t, b)
+		var r []byte
+		if line.n != 0 {
+			r = make([]byte, line.n)
+		}
+		if err := i.Tx(0x10, line.w, r); err != nil {
+			t.Fatalf("%s: %v", line.name, err)
+		}
+		if !reflect.DeepEqual(b.slave.frames, line.expected) {
+			t.Fatalf("%s: %#v != %#v", line.name, b.slave.frames, line.expected)
+		}
+		if line.n != 0 && r[0] != 0x42 {
+			t.Fatalf("%s: %#x", line.name, r[0])
+		}
+	}
+}
+
+func TestTx_CommandOnly(t *testing.T) {
+	// Display controllers like the SSD1306 take a command as a write without
+	// any read.
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x42}}}
+	i := newFakeI2C(t, b)
+	if err := i.Tx(0x3C, []byte{0xAF}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.slave.starts != 1 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	expected := [][]byte{{0x3C << 1, 0xAF}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	// No byte was read.
+	if len(b.slave.acks) != 0 {
+		t.Fatalf("%#v", b.slave.acks)
+	}
+}
+
+func TestTx_RepeatedStart(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x68, 0x10}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 2)
+	if err := i.Tx(0x10, []byte{0x09}, r); err != nil {
+		t.Fatal(err)
+	}
+	// One START, one repeated START and one STOP.
+	if b.slave.starts != 2 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	expected := [][]byte{{0x10 << 1, 0x09}, {0x10<<1 | 1}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if !reflect.DeepEqual(r, []byte{0x68, 0x10}) {
+		t.Fatalf("%#v", r)
+	}
+}
+
+func TestTx_AddrLSB(t *testing.T) {
+	data := []struct {
+		name     string
+		w        []byte
+		n        int
+		expected gpio.Level
+	}{
+		{"write-only", []byte{0x01}, 0, gpio.Low},
+		{"read-only", nil, 1, gpio.High},
+	}
+	for _, line := range data {
+		b := &fakeWire{slave: &fakeSlave{tx: []byte{0x42}}}
+		i := newFakeI2C(t, b)
+		b.reset()
+		var r []byte
+		if line.n != 0 {
+			r = make([]byte, line.n)
+		}
+		if err := i.Tx(0x10, line.w, r); err != nil {
+			t.Fatalf("%s: %v", line.name, err)
+		}
+		// The trace starts with both lines high; skip the START.
+		if b.trace[0] != "D0" || b.trace[1] != "C0" {
+			t.Fatalf("%s: %v", line.name, b.trace)
+		}
+		if bit := sampledBits(b.trace[2:])[7]; bit != line.expected {
+			t.Fatalf("%s: R/W bit %s != %s", line.name, bit, line.expected)
+		}
+	}
+}
+
+func TestTx_Probe_NACK(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return true }}}
+	i := newFakeI2C(t, b)
+	err := i.Tx(0x10, nil, nil)
+	if e, ok := err.(*NACKError); !ok || e.Phase != "address" || e.Value != 0x10<<1 {
+		t.Fatal(err)
+	}
+}
+
+func TestTx_Empty(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.Tx(0x10, []byte{}, []byte{}); err == nil || !strings.Contains(err.Error(), "empty transfer") {
+		t.Fatal(err)
+	}
+	if err := i.Tx(0x10, []byte{}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := i.Tx(0x10, nil, []byte{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(b.trace) != 0 {
+		t.Fatal(b.trace)
+	}
+}
+
+func TestTx_10bits_Write(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	if err := i.Tx(0x3C0, []byte{0x12, 0x34}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{{0xF6, 0xC0, 0x12, 0x34}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestTx_10bits_Read(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x42}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 1)
+	if err := i.Tx(0x3C0, []byte{0x01}, r); err != nil {
+		t.Fatal(err)
+	}
+	// The repeated START only re-sends the first address byte, with R/W set.
+	expected := [][]byte{{0xF6, 0xC0, 0x01}, {0xF7}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if r[0] != 0x42 {
+		t.Fatalf("%#x", r[0])
+	}
+}
+
+func TestTx_10bits_Invalid(t *testing.T) {
+	b := &fakeWire{}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if i.Tx(0x400, nil, nil) == nil {
+		t.Fatal("expected error")
+	}
+	if len(b.trace) != 0 {
+		t.Fatal(b.trace)
+	}
+}
+
+func TestTx_ClockStretchTimeout(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}, stretch: -1}
+	i := newFakeI2C(t, b)
+	i.SetClockStretchTimeout(10 * time.Millisecond)
+	start := time.Now()
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != ErrClockStretchTimeout {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected duration %s", d)
+	}
+}
+
+func TestStop_ClockStretchTimeout(t *testing.T) {
+	// The slave holds SCL low during the STOP, after the 18 clocks of the
+	// address and the byte.
+	b := &fakeWire{slave: &fakeSlave{}, stretch: -1, stretchAt: 19}
+	i := newFakeI2C(t, b)
+	i.SetClockStretchTimeout(10 * time.Millisecond)
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != ErrClockStretchTimeout {
+		t.Fatal(err)
+	}
+	if b.sdaM != gpio.High || b.sclM != gpio.High {
+		t.Fatal("expected both lines to be released")
+	}
+}
+
+func TestWriteByte_ClockStretch(t *testing.T) {
+	// The slave holds SCL low during the 3rd bit of the address, which must be
+	// waited for before the bit is sent.
+	b := &fakeWire{slave: &fakeSlave{}, stretch: 3, stretchAt: 3}
+	i := newFakeI2C(t, b)
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{{0x20, 0x01}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestWriteByte_MSBFirst(t *testing.T) {
+	// 0x81 is the golden value; 0x03 is not a palindrome so it catches a
+	// reversed order.
+	data := []struct {
+		v        byte
+		expected []gpio.Level
+	}{
+		{0x81, []gpio.Level{true, false, false, false, false, false, false, true}},
+		{0x03, []gpio.Level{false, false, false, false, false, false, true, true}},
+	}
+	for _, line := range data {
+		b := &fakeWire{slave: &fakeSlave{}}
+		i := newFakeI2C(t, b)
+		if err := i.start(); err != nil {
+			t.Fatal(err)
+		}
+		b.reset()
+		if _, err := i.writeByte(line.v); err != nil {
+			t.Fatal(err)
+		}
+		// SDA as sampled on each rising edge of SCL, excluding the ACK clock.
+		if bits := sampledBits(b.trace)[:8]; !reflect.DeepEqual(bits, line.expected) {
+			t.Fatalf("%#x: %v != %v", line.v, bits, line.expected)
+		}
+	}
+}
+
+func TestReadByte_MSBFirst(t *testing.T) {
+	for _, v := range []byte{0x81, 0x03} {
+		b := &fakeWire{slave: &fakeSlave{tx: []byte{v}}}
+		i := newFakeI2C(t, b)
+		if err := i.start(); err != nil {
+			t.Fatal(err)
+		}
+		if ack, err := i.writeByte(0x10<<1 | 1); !ack || err != nil {
+			t.Fatal(ack, err)
+		}
+		got, err := i.readByte(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v {
+			t.Fatalf("%#x != %#x", got, v)
+		}
+	}
+}
+
+func TestBytes_AllValues(t *testing.T) {
+	var all []byte
+	for v := 0; v < 256; v++ {
+		all = append(all, byte(v))
+	}
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	if err := i.Tx(0x10, all, nil); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{append([]byte{0x10 << 1}, all...)}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	b = &fakeWire{slave: &fakeSlave{tx: all}}
+	i = newFakeI2C(t, b)
+	r := make([]byte, len(all))
+	if err := i.Tx(0x10, nil, r); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, all) {
+		t.Fatalf("%#v != %#v", r, all)
+	}
+}
+
+func TestWriteByte_HalfCycles(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	if err := i.start(); err != nil {
+		t.Fatal(err)
+	}
+	var total time.Duration
+	i.delay = func(d time.Duration) { total += d }
+	if _, err := i.writeByte(0xA5); err != nil {
+		t.Fatal(err)
+	}
+	// 8 data bits and the ACK, 2 half-cycles each.
+	if n := total / i.halfCycle; n != 18 || total%i.halfCycle != 0 {
+		t.Fatalf("%s is %d half-cycles", total, n)
+	}
+}
+
+func TestReadByte_ClockStretch(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0xC3}}}
+	i := newFakeI2C(t, b)
+	i.start()
+	if ack, err := i.writeByte(0x10<<1 | 1); !ack || err != nil {
+		t.Fatal(ack, err)
+	}
+	// Hold SCL low for two reads after each release.
+	b.mu.Lock()
+	b.stretch = 2
+	b.earlyReads = 0
+	b.mu.Unlock()
+	v, err := i.readByte(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0xC3 {
+		t.Fatalf("%#x", v)
+	}
+	if b.earlyReads != 0 {
+		t.Fatalf("SDA was sampled %d times while SCL was held low", b.earlyReads)
+	}
+}
+
+func TestTx_ReadNACKLast(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x01, 0x02, 0x03}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 3)
+	if err := i.TxRepeatedStart(0x10, []byte{0x00}, r); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x01, 0x02, 0x03}; !reflect.DeepEqual(r, expected) {
+		t.Fatalf("%#v != %#v", r, expected)
+	}
+	if expected := []bool{true, true, false}; !reflect.DeepEqual(b.slave.acks, expected) {
+		t.Fatalf("%#v != %#v", b.slave.acks, expected)
+	}
+	if b.slave.stops != 1 {
+		t.Fatalf("stops=%d", b.slave.stops)
+	}
+}
+
+func TestTx_NACK(t *testing.T) {
+	data := []struct {
+		nack     func(f []byte) bool
+		expected NACKError
+	}{
+		{
+			func(f []byte) bool { return true },
+			NACKError{Phase: "address", Index: 0, Value: 0x10 << 1},
+		},
+		{
+			func(f []byte) bool { return len(f) == 3 },
+			NACKError{Phase: "write", Index: 1, Value: 0x02},
+		},
+		{
+			func(f []byte) bool { return len(f) == 1 && f[0] == 0xF7 },
+			NACKError{Phase: "read-restart", Index: 0, Value: 0xF7},
+		},
+	}
+	for x, line := range data {
+		i := newFakeI2C(t, &fakeWire{slave: &fakeSlave{nack: line.nack}})
+		addr := uint16(0x10)
+		var r []byte
+		if line.expected.Phase == "read-restart" {
+			addr = 0x3C0
+			r = make([]byte, 1)
+		}
+		err := i.Tx(addr, []byte{0x01, 0x02, 0x03}, r)
+		e, ok := err.(*NACKError)
+		if !ok {
+			t.Fatalf("#%d: unexpected error %v", x, err)
+		}
+		if *e != line.expected {
+			t.Fatalf("#%d: %#v != %#v", x, *e, line.expected)
+		}
+		if s := e.Error(); !strings.HasPrefix(s, "bitbang-i2c: got NACK") {
+			t.Fatalf("#%d: %s", x, s)
+		}
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	var traces [][]string
+	var reads [][]byte
+	for _, f := range []func(i *I2C, r []byte) error{
+		func(i *I2C, r []byte) error { return i.Tx(0x0B, []byte{0x0D}, r) },
+		func(i *I2C, r []byte) error { return i.WriteRead(0x0B, []byte{0x0D}, r) },
+	} {
+		b := &fakeWire{slave: &fakeSlave{tx: []byte{0x64, 0x00}}}
+		i := newFakeI2C(t, b)
+		r := make([]byte, 2)
+		if err := f(i, r); err != nil {
+			t.Fatal(err)
+		}
+		expected := [][]byte{{0x16, 0x0D}, {0x17}}
+		if !reflect.DeepEqual(b.slave.frames, expected) {
+			t.Fatalf("%#v != %#v", b.slave.frames, expected)
+		}
+		traces = append(traces, b.trace)
+		reads = append(reads, r)
+	}
+	if !reflect.DeepEqual(traces[0], traces[1]) {
+		t.Fatalf("%v != %v", traces[0], traces[1])
+	}
+	if !reflect.DeepEqual(reads[0], reads[1]) {
+		t.Fatalf("%#v != %#v", reads[0], reads[1])
+	}
+}
+
+func TestTxRepeatedStart(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x64}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 1)
+	if err := i.TxRepeatedStart(0x0B, []byte{0x0D}, r); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != 0x64 {
+		t.Fatalf("%#x", r[0])
+	}
+	// Exactly one START and one repeated START.
+	if b.slave.starts != 2 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	expected := [][]byte{{0x16, 0x0D}, {0x17}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestTxRepeatedStart_SkipAddr(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	var log []string
+	i.SetLogger(func(format string, args ...interface{}) {
+		log = append(log, fmt.Sprintf(format, args...))
+	})
+	r := make([]byte, 1)
+	if err := i.TxRepeatedStart(SkipAddr, []byte{0x01, 0x02}, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"bitbang-i2c: START",
+		"bitbang-i2c: write 0x01 ACK",
+		"bitbang-i2c: write 0x02 ACK",
+		"bitbang-i2c: START",
+		"bitbang-i2c: read 0xFF NACK",
+		"bitbang-i2c: STOP",
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("%#v != %#v", log, expected)
+	}
+	if b.slave.starts != 2 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+}
+
+func TestTxRepeatedStart_WakePulse(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x64}}}
+	i := newFakeI2C(t, b)
+	i.SetWakePulse(true)
+	r := make([]byte, 1)
+	if err := i.TxRepeatedStart(0x0B, []byte{0x0D}, r); err != nil {
+		t.Fatal(err)
+	}
+	if b.slave.starts != 3 || b.slave.stops != 2 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	expected := [][]byte{nil, {0x16, 0x0D}, {0x17}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestSleepHalfCycle(t *testing.T) {
+	measure := func(f physic.Frequency) time.Duration {
+		i := newFakeI2C(t, &fakeWire{})
+		i.delay = sleep
+		if err := i.SetSpeed(f); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		for x := 0; x < 5; x++ {
+			i.sleepHalfCycle()
+		}
+		return time.Since(start)
+	}
+	// Use slow speeds, as the OS timer granularity can be as coarse as 1ms on
+	// virtualized hosts.
+	slow := measure(20 * physic.Hertz)
+	fast := measure(200 * physic.Hertz)
+	// The ratio should be 10x, leave some slack for scheduling noise.
+	if r := float64(slow) / float64(fast); r < 4 || r > 20 {
+		t.Fatalf("unexpected ratio %.1f (%s vs %s)", r, slow, fast)
+	}
+}
+
+func TestNew_InvalidSpeed(t *testing.T) {
+	b := &fakeWire{}
+	if _, err := New(&fakePin{w: b, clk: true}, &fakePin{w: b}, 0); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSetSpeed(t *testing.T) {
+	i := newFakeI2C(t, &fakeWire{})
+	for _, f := range []physic.Frequency{0, -physic.KiloHertz, physic.GigaHertz} {
+		if err := i.SetSpeed(f); err == nil {
+			t.Fatalf("%s: expected error", f)
+		}
+	}
+	if err := i.SetSpeed(400 * physic.KiloHertz); err != nil {
+		t.Fatal(err)
+	}
+	if i.halfCycle != 1250*time.Nanosecond {
+		t.Fatal(i.halfCycle)
+	}
+	if i.low != 1250*time.Nanosecond || i.high != 1250*time.Nanosecond {
+		t.Fatal(i.low, i.high)
+	}
+}
+
+func TestSetSpeed_Busy(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}, stretch: -1}
+	i := newFakeI2C(t, b)
+	i.SetClockStretchTimeout(time.Second)
+	done := make(chan error)
+	go func() {
+		done <- i.Tx(0x10, []byte{0x01}, nil)
+	}()
+	for atomic.LoadInt32(&i.busy) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := i.SetSpeed(100 * physic.KiloHertz); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := <-done; err != ErrClockStretchTimeout {
+		t.Fatal(err)
+	}
+}
+
+func TestTxContext_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel the context once the second data byte is received.
+	nack := func(f []byte) bool {
+		if len(f) == 3 {
+			cancel()
+		}
+		return false
+	}
+	b := &fakeWire{slave: &fakeSlave{nack: nack}}
+	i := newFakeI2C(t, b)
+	if err := i.TxContext(ctx, 0x10, []byte{0x01, 0x02, 0x03, 0x04}, nil); err != context.Canceled {
+		t.Fatal(err)
+	}
+	expected := [][]byte{{0x10 << 1, 0x01, 0x02}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if b.slave.stops != 1 {
+		t.Fatal("expected STOP")
+	}
+}
+
+func TestTxContext_CancelStretch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	b := &fakeWire{slave: &fakeSlave{}, stretch: -1}
+	i := newFakeI2C(t, b)
+	if err := i.TxContext(ctx, 0x10, []byte{0x01}, nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTransactionTimeout(t *testing.T) {
+	// The slave is slow to process each byte, without ever stretching the
+	// clock long enough to time out.
+	nack := func(f []byte) bool {
+		time.Sleep(5 * time.Millisecond)
+		return false
+	}
+	b := &fakeWire{slave: &fakeSlave{nack: nack}}
+	i := newFakeI2C(t, b)
+	if err := i.SetTransactionTimeout(-1); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := i.SetTransactionTimeout(12 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Tx(0x10, make([]byte, 100), nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if n := len(b.slave.frames[0]); n < 2 || n > 10 {
+		t.Fatalf("%d bytes were sent", n)
+	}
+	if b.slave.stops != 1 {
+		t.Fatal("expected STOP")
+	}
+	if !b.scl || !b.sda {
+		t.Fatal("expected the bus to be idle")
+	}
+	// The timeout applies to each transaction.
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	b := &fakeWire{hold: 3}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	// Three clocks to release SDA, then a STOP.
+	expected := []string{
+		"C0", "C1", "C0", "C1", "C0", "C1", "D1",
+		"C0", "D0", "C1", "D1",
+	}
+	if !reflect.DeepEqual(b.trace, expected) {
+		t.Fatalf("unexpected trace\n%v\n%v", b.trace, expected)
+	}
+	if !b.scl || !b.sda {
+		t.Fatal("expected the bus to be idle")
+	}
+}
+
+func TestRecover_Stuck(t *testing.T) {
+	b := &fakeWire{hold: -1}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.Recover(); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := strings.Count(strings.Join(b.trace, ""), "C1"); n != 9 {
+		t.Fatalf("expected 9 clocks, got %d", n)
+	}
+}
+
+func TestTx_ArbitrationLost(t *testing.T) {
+	// Another master pulls SDA low during the 3rd bit of the address.
+	b := &fakeWire{slave: &fakeSlave{}, contendAt: 3}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.Tx(0x77, []byte{0x01}, nil); err != ErrArbitrationLost {
+		t.Fatal(err)
+	}
+	// The master gave up the bus right away without a STOP.
+	if b.slave.stops != 0 {
+		t.Fatal("unexpected STOP")
+	}
+	if !b.sclM || !b.sdaM {
+		t.Fatal("expected the lines to be released")
+	}
+	if b.contention {
+		t.Fatal("SDA was driven high against the other master")
+	}
+	if n := strings.Count(strings.Join(b.trace, ""), "C1"); n != 3 {
+		t.Fatalf("expected 3 clocks, got %d", n)
+	}
+}
+
+func TestSetAllowReservedAddresses(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	b.reset()
+	for _, addr := range []uint16{0x00, 0x07, 0x78, 0x7F} {
+		if err := i.Tx(addr, []byte{0x01}, nil); err == nil {
+			t.Fatalf("%#x: expected error", addr)
+		}
+		if _, err := i.Probe(addr); err == nil {
+			t.Fatalf("%#x: expected error", addr)
+		}
+	}
+	if len(b.trace) != 0 {
+		t.Fatal(b.trace)
+	}
+	// The boundaries, 10-bit addresses and SkipAddr are accepted.
+	for _, addr := range []uint16{0x08, 0x77, 0x80, 0x3FF, SkipAddr} {
+		if err := i.Tx(addr, []byte{0x01}, nil); err != nil {
+			t.Fatalf("%#x: %v", addr, err)
+		}
+	}
+	i.SetAllowReservedAddresses(true)
+	b.slave.frames = nil
+	if err := i.Tx(0x00, []byte{0x06}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{{0x00, 0x06}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if err := i.Tx(0x400, nil, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestGeneralCall(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	if err := i.SoftwareReset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.GeneralCall(0x04); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{{0x00, 0x06}, {0x00, 0x04}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if b.slave.stops != 2 {
+		t.Fatal(b.slave.stops)
+	}
+	// The reserved addresses are still rejected otherwise.
+	if err := i.Tx(0x00, []byte{0x06}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestGeneralCall_NACK(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return true }}}
+	i := newFakeI2C(t, b)
+	err := i.SoftwareReset()
+	expected := &NACKError{Phase: "address", Index: 0, Value: 0x00}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("%v != %v", err, expected)
+	}
+}
+
+func TestTx_BusBusy(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}, hold: -1}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != ErrBusBusy {
+		t.Fatal(err)
+	}
+	// SDA is stuck low: the 9 clocks to clear the bus are issued, but no START.
+	if n := strings.Count(strings.Join(b.trace, ""), "C1"); n != 9 || strings.Contains(strings.Join(b.trace, ""), "D") {
+		t.Fatal(b.trace)
+	}
+}
+
+func TestTx_SDAHeldLow(t *testing.T) {
+	// A slave holds SDA low for 3 clocks, then releases it.
+	b := &fakeWire{slave: &fakeSlave{}, hold: 3}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The bus was cleared like Recover does, then the transaction went on.
+	expected := []string{
+		"C0", "C1", "C0", "C1", "C0", "C1", "D1",
+		"C0", "D0", "C1", "D1",
+		"D0", "C0",
+	}
+	if !reflect.DeepEqual(b.trace[:len(expected)], expected) {
+		t.Fatalf("unexpected trace\n%v\n%v", b.trace, expected)
+	}
+	if f := b.slave.frames[len(b.slave.frames)-1]; !reflect.DeepEqual(f, []byte{0x10 << 1, 0x01}) {
+		t.Fatalf("%#v", b.slave.frames)
+	}
+}
+
+func TestTxRepeatedStart_RestartNACK(t *testing.T) {
+	// The slave doesn't acknowledge its address on the repeated START.
+	nack := func(f []byte) bool { return len(f) == 1 && f[0]&1 == 1 }
+	b := &fakeWire{slave: &fakeSlave{nack: nack, tx: []byte{0x55}}}
+	i := newFakeI2C(t, b)
+	r := []byte{0xAA, 0xAA}
+	err := i.TxRepeatedStart(0x10, []byte{0x01}, r)
+	expected := &NACKError{Phase: "read-restart", Index: 0, Value: 0x21}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("%v != %v", err, expected)
+	}
+	// Nothing was read and the stale content is not left behind.
+	if !reflect.DeepEqual(r, []byte{0x00, 0x00}) {
+		t.Fatalf("%#v", r)
+	}
+	if b.slave.stops != 1 {
+		t.Fatal("expected STOP")
+	}
+}
+
+func TestTxSequence_ZeroOnError(t *testing.T) {
+	// The bytes read are zeroed when a following operation fails.
+	nack := func(f []byte) bool { return len(f) == 2 && f[0]&1 == 0 }
+	b := &fakeWire{slave: &fakeSlave{nack: nack, tx: []byte{0x55}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 1)
+	ops := []Op{{Read: true, Buf: r}, {Buf: []byte{0x01}}}
+	if err := i.TxSequence(0x10, ops); err == nil {
+		t.Fatal("expected error")
+	}
+	if b.slave.frames[0][0] != 0x21 || r[0] != 0 {
+		t.Fatalf("%#v %#v", b.slave.frames, r)
+	}
+}
+
+func TestTxSequence(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 1)
+	ops := []Op{
+		{Buf: []byte{0x01}},
+		{Buf: []byte{0x02, 0x03}},
+		{Read: true, Buf: r},
+	}
+	if err := i.TxSequence(0x10, ops); err != nil {
+		t.Fatal(err)
+	}
+	// One START, two repeated STARTs and one STOP.
+	if b.slave.starts != 3 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	expected := [][]byte{{0x20, 0x01}, {0x20, 0x02, 0x03}, {0x21}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if r[0] != 0x55 {
+		t.Fatalf("%#x", r[0])
+	}
+}
+
+func TestTxSequence_10bits(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 1)
+	if err := i.TxSequence(0x3C0, []Op{{Read: true, Buf: r}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{{0xF6, 0xC0}, {0xF7}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestTxStream(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	chunks := [][]byte{{0x00}, nil, {0x01, 0x02}, {0x03}}
+	if err := i.TxStream(0x10, chunks, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The address is sent once.
+	if b.slave.starts != 1 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	expected := [][]byte{{0x20, 0x00, 0x01, 0x02, 0x03}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestTxStream_Read(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 1)
+	if err := i.TxStream(0x10, [][]byte{{0x00}, {0x01}}, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{{0x20, 0x00, 0x01}, {0x21}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if r[0] != 0x55 {
+		t.Fatalf("%#x", r[0])
+	}
+}
+
+func TestTxStream_NACK(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return len(f) == 4 }}}
+	i := newFakeI2C(t, b)
+	err := i.TxStream(0x10, [][]byte{{0x00}, {0x01, 0x02}}, nil)
+	expected := &NACKError{Phase: "write", Index: 2, Value: 0x02}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("%v != %v", err, expected)
+	}
+}
+
+func TestTxStream_Empty(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.TxStream(0x10, [][]byte{nil, {}}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(b.trace) != 0 {
+		t.Fatal(b.trace)
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	tx := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	b := &fakeWire{slave: &fakeSlave{tx: tx}}
+	i := newFakeI2C(t, b)
+	r := make([]byte, 10)
+	if err := i.ReadStream(0x50, []byte{0x00}, r, 4); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, tx) {
+		t.Fatalf("%#v", r)
+	}
+	// A single transaction with one repeated START.
+	if b.slave.starts != 2 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	// Only the last byte is NACK'ed, not the last bytes of the chunks.
+	expected := []bool{true, true, true, true, true, true, true, true, true, false}
+	if !reflect.DeepEqual(b.slave.acks, expected) {
+		t.Fatalf("%#v != %#v", b.slave.acks, expected)
+	}
+}
+
+func TestReadStream_Invalid(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.ReadStream(0x50, nil, make([]byte, 1), 0); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := i.ReadStream(0x50, nil, nil, 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(b.trace) != 0 {
+		t.Fatal(b.trace)
+	}
+}
+
+func TestReadReg(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x12, 0x34, 0x56}}}
+	i := newFakeI2C(t, b)
+	if v, err := i.ReadReg16BE(0x10, 0x02); err != nil || v != 0x1234 {
+		t.Fatalf("%#x, %v", v, err)
+	}
+	if expected := [][]byte{{0x10 << 1, 0x02}, {0x10<<1 | 1}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	data := []struct {
+		name     string
+		f        func(i *I2C) (uint32, error)
+		expected uint32
+	}{
+		{"16LE", func(i *I2C) (uint32, error) { v, err := i.ReadReg16LE(0x10, 0x02); return uint32(v), err }, 0x3412},
+		{"24BE", func(i *I2C) (uint32, error) { return i.ReadReg24BE(0x10, 0x02) }, 0x123456},
+		{"24LE", func(i *I2C) (uint32, error) { return i.ReadReg24LE(0x10, 0x02) }, 0x563412},
+	}
+	for _, line := range data {
+		i := newFakeI2C(t, &fakeWire{slave: &fakeSlave{tx: []byte{0x12, 0x34, 0x56}}})
+		if v, err := line.f(i); err != nil || v != line.expected {
+			t.Fatalf("%s: %#x, %v", line.name, v, err)
+		}
+	}
+	// Errors are returned as is.
+	i = newFakeI2C(t, &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return true }}})
+	if _, err := i.ReadReg16BE(0x10, 0x02); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSetRiseTime(t *testing.T) {
+	const rise = 20 * time.Millisecond
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	i.delay = sleep
+	i.SetRiseTime(rise)
+	b.reset()
+	if err := i.Tx(0x10, []byte{0xA5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.drives) < 2 {
+		t.Fatal(b.drives)
+	}
+	for x, d := range b.drives[:len(b.drives)-1] {
+		gap := b.drives[x+1].t.Sub(d.t)
+		if d.l == gpio.High && gap < rise {
+			t.Fatalf("#%d: release was followed by %s", x, gap)
+		}
+		if d.l == gpio.Low && gap >= rise {
+			t.Fatalf("#%d: drive low was followed by %s", x, gap)
+		}
+	}
+}
+
+func TestSetReadSettle(t *testing.T) {
+	const settle = 777 * time.Nanosecond
+	b := &fakeWire{}
+	i, err := New(&fakePin{w: b, clk: true}, &samplingPin{fakePin: fakePin{w: b}}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.delay = func(d time.Duration) {
+		if d == settle {
+			b.trace = append(b.trace, "W")
+		}
+	}
+	if err := i.SetReadSettle(-1); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := i.SetReadSettle(settle); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.start(); err != nil {
+		t.Fatal(err)
+	}
+	b.reset()
+	if _, err := i.readByte(true); err != nil {
+		t.Fatal(err)
+	}
+	// Each bit is sampled once, after SCL rose then the settle delay.
+	reads := 0
+	for x, e := range b.trace {
+		if e != "R" {
+			continue
+		}
+		reads++
+		if x < 2 || b.trace[x-1] != "W" || b.trace[x-2] != "C1" {
+			t.Fatalf("#%d: %v", x, b.trace)
+		}
+	}
+	if reads != 8 {
+		t.Fatal(b.trace)
+	}
+}
+
+func TestSpeed(t *testing.T) {
+	i := newFakeI2C(t, &fakeWire{})
+	if f := i.Speed(); f != physic.MegaHertz {
+		t.Fatal(f)
+	}
+	data := []physic.Frequency{400 * physic.KiloHertz, 100 * physic.KiloHertz, 3 * physic.KiloHertz}
+	for _, f := range data {
+		if err := i.SetSpeed(f); err != nil {
+			t.Fatal(err)
+		}
+		// The period is rounded to the nanosecond.
+		if got := i.Speed(); got < f*999/1000 || got > f*1001/1000 {
+			t.Fatalf("%s != %s", got, f)
+		}
+	}
+	if err := i.SetSpeed(400 * physic.KiloHertz); err != nil {
+		t.Fatal(err)
+	}
+	if s := i.String(); s != "bitbang/i2c(SCL, SDA)@400kHz" {
+		t.Fatal(s)
+	}
+	if err := i.SetClockTiming(6*time.Microsecond, 4*time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if f := i.Speed(); f != 100*physic.KiloHertz {
+		t.Fatal(f)
+	}
+}
+
+func TestSetPushPullClock(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+	clk := &fakePin{w: b, clk: true}
+	i, err := New(clk, &fakePin{w: b}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	r := make([]byte, 1)
+	// By default, SCL is released to the pull-up for the clocks that may be
+	// stretched.
+	clk.inPulls = nil
+	b.pushPulls = 0
+	if err := i.Tx(0x10, nil, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(clk.inPulls) == 0 {
+		t.Fatal("expected SCL to be released")
+	}
+	if b.pushPulls != 0 {
+		t.Fatal(b.pushPulls)
+	}
+	if err := i.SetPushPullClock(true); err != nil {
+		t.Fatal(err)
+	}
+	b.slave = &fakeSlave{tx: []byte{0x55}}
+	clk.inPulls = nil
+	outs := clk.outs
+	if err := i.Tx(0x10, nil, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(clk.inPulls) != 0 {
+		t.Fatal(clk.inPulls)
+	}
+	if b.pushPulls == 0 {
+		t.Fatal("expected SCL to be driven high")
+	}
+	// Address then data: 2 bytes of 9 clocks, each driven high then low, plus
+	// one for the START and two for the STOP.
+	if n := clk.outs - outs; n != 2*9*2+3 {
+		t.Fatal(n)
+	}
+	if r[0] != 0x55 {
+		t.Fatalf("%#x", r[0])
+	}
+	if !b.sclPP {
+		t.Fatal("expected SCL to be left driven high")
+	}
+	// Disabling it releases SCL right away.
+	clk.inPulls = nil
+	if err := i.SetPushPullClock(false); err != nil {
+		t.Fatal(err)
+	}
+	if b.sclPP || !reflect.DeepEqual(clk.inPulls, []gpio.Pull{gpio.PullUp}) {
+		t.Fatal(b.sclPP, clk.inPulls)
+	}
+}
+
+func TestSetPushPullClock_OpenDrain(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	clk := &fakeOpenDrainPin{fakePin: fakePin{w: b, clk: true}}
+	i, err := New(clk, &fakeOpenDrainPin{fakePin: fakePin{w: b}}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	b.pushPulls = 0
+	if err := i.Tx(0x10, []byte{0xFF}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.pushPulls != 0 {
+		t.Fatal(b.pushPulls)
+	}
+	if err := i.SetPushPullClock(true); err != nil {
+		t.Fatal(err)
+	}
+	if clk.fn != gpio.OUT {
+		t.Fatal(clk.fn)
+	}
+	if err := i.Tx(0x10, []byte{0xFF}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.pushPulls == 0 {
+		t.Fatal("expected SCL to be driven high")
+	}
+	if err := i.SetPushPullClock(false); err != nil {
+		t.Fatal(err)
+	}
+	if clk.fn != gpio.OUT_OC || !i.sclOpenDrain {
+		t.Fatal(clk.fn)
+	}
+	clk.err = errors.New("not supported")
+	if err := i.SetPushPullClock(true); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSetPersistentConfig(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	clk := &fakePin{w: b, clk: true}
+	i, err := New(clk, &fakePin{w: b}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Something else reconfigures SCL as an output driven low.
+	if err := clk.Out(gpio.Low); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != ErrBusBusy {
+		t.Fatal(err)
+	}
+	i.SetPersistentConfig(true)
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{{0x10 << 1, 0x01}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if !b.scl || !b.sda {
+		t.Fatal("expected the bus to be idle")
+	}
+}
+
+func TestSetDataSetupTime(t *testing.T) {
+	const low = 2 * time.Millisecond
+	const setup = 500 * time.Microsecond
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	i.delay = sleep
+	if err := i.SetDataSetupTime(-1); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := i.SetClockTiming(low, 100*time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.SetDataSetupTime(setup); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.start(); err != nil {
+		t.Fatal(err)
+	}
+	b.reset()
+	if _, err := i.writeByte(0xA5); err != nil {
+		t.Fatal(err)
+	}
+	// For each of the 8 data bits, SDA changes after the data hold part of the
+	// low period and at least tSU;DAT before SCL rises.
+	var fall, data time.Time
+	bits := 0
+	for _, d := range b.drives {
+		switch {
+		case d.clk && d.l == gpio.Low:
+			fall = d.t
+		case !d.clk && bits < 8:
+			data = d.t
+		case d.clk && d.l == gpio.High && bits < 8:
+			if s := d.t.Sub(data); s < setup {
+				t.Fatalf("bit %d: setup %s < %s", bits, s, setup)
+			}
+			if !fall.IsZero() {
+				if h := data.Sub(fall); h < low-setup {
+					t.Fatalf("bit %d: SDA changed %s after SCL fell", bits, h)
+				}
+			}
+			bits++
+		}
+	}
+	if bits != 8 {
+		t.Fatal(bits)
+	}
+}
+
+func TestSetStartStopTiming(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	var delays []time.Duration
+	i.delay = func(d time.Duration) { delays = append(delays, d) }
+	data := []struct {
+		f           physic.Frequency
+		hold, setup time.Duration
+	}{
+		// Defaults to half a period.
+		{100 * physic.KiloHertz, 0, 0},
+		{400 * physic.KiloHertz, 0, 0},
+		{100 * physic.KiloHertz, 6 * time.Microsecond, 7 * time.Microsecond},
+		{physic.MegaHertz, 260 * time.Nanosecond, time.Microsecond},
+	}
+	for x, line := range data {
+		if err := i.SetSpeed(line.f); err != nil {
+			t.Fatal(err)
+		}
+		hold, setup := line.f.Period()/2, line.f.Period()/2
+		if line.hold != 0 {
+			if err := i.SetStartStopTiming(line.hold, line.setup); err != nil {
+				t.Fatal(err)
+			}
+			hold, setup = line.hold, line.setup
+		}
+		delays = nil
+		if err := i.start(); err != nil {
+			t.Fatal(err)
+		}
+		// START waits for the rest of tBUF after the previous STOP, if any, then
+		// for tHD;STA.
+		if len(delays) == 0 || len(delays) > 2 || delays[len(delays)-1] != hold {
+			t.Fatalf("#%d: START %v", x, delays)
+		}
+		delays = nil
+		if err := i.stop(); err != nil {
+			t.Fatal(err)
+		}
+		// SCL low period then tSU;STO.
+		if len(delays) != 2 || delays[1] != setup {
+			t.Fatalf("#%d: STOP %v", x, delays)
+		}
+	}
+}
+
+func TestBusFreeTime(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	now := time.Unix(0, 0)
+	i.now = func() time.Time { return now }
+	var delays []time.Duration
+	i.delay = func(d time.Duration) { delays = append(delays, d) }
+	if err := i.SetSpeed(400 * physic.KiloHertz); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The second transaction starts right away; START waits for the whole
+	// tBUF first.
+	delays = nil
+	if err := i.Tx(0x10, []byte{0x02}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if delays[0] != 1300*time.Nanosecond {
+		t.Fatal(delays)
+	}
+	// Only the remainder is waited for.
+	now = now.Add(time.Microsecond)
+	delays = nil
+	if err := i.Tx(0x10, []byte{0x03}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if delays[0] != 300*time.Nanosecond {
+		t.Fatal(delays)
+	}
+	// Nothing is waited for once tBUF elapsed.
+	now = now.Add(2 * time.Microsecond)
+	delays = nil
+	if err := i.Tx(0x10, []byte{0x04}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if delays[0] != i.startHold {
+		t.Fatal(delays)
+	}
+	// No wait before a repeated START.
+	b.slave.tx = []byte{0x55}
+	now = now.Add(time.Millisecond)
+	delays = nil
+	if err := i.Tx(0x10, []byte{0x05}, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range delays {
+		if d == 1300*time.Nanosecond {
+			t.Fatal(delays)
+		}
+	}
+}
+
+func TestSetStartStopTiming_Invalid(t *testing.T) {
+	i := newFakeI2C(t, &fakeWire{slave: &fakeSlave{}})
+	data := []struct {
+		f   physic.Frequency
+		min time.Duration
+	}{
+		{100 * physic.KiloHertz, 4 * time.Microsecond},
+		{400 * physic.KiloHertz, 600 * time.Nanosecond},
+		{physic.MegaHertz, 260 * time.Nanosecond},
+	}
+	for _, line := range data {
+		if err := i.SetSpeed(line.f); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.SetStartStopTiming(line.min-1, line.min); err == nil {
+			t.Fatalf("%s: expected error", line.f)
+		}
+		if err := i.SetStartStopTiming(line.min, line.min-1); err == nil {
+			t.Fatalf("%s: expected error", line.f)
+		}
+		if err := i.SetStartStopTiming(line.min, line.min); err != nil {
+			t.Fatalf("%s: %v", line.f, err)
+		}
+	}
+}
+
+func TestSetClockTiming(t *testing.T) {
+	const low, high = 2 * time.Millisecond, 10 * time.Millisecond
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	i.delay = sleep
+	if err := i.SetClockTiming(0, high); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := i.SetClockTiming(low, high); err != nil {
+		t.Fatal(err)
+	}
+	b.reset()
+	if err := i.Tx(0x10, []byte{0xA5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Only keep the SCL changes.
+	var scl []fakeDrive
+	for _, d := range b.drives {
+		if d.clk && (len(scl) == 0 || scl[len(scl)-1].l != d.l) {
+			scl = append(scl, d)
+		}
+	}
+	if len(scl) < 18 {
+		t.Fatal(scl)
+	}
+	// The first transition is the START hold time.
+	for x := 1; x < len(scl)-1; x++ {
+		gap := scl[x+1].t.Sub(scl[x].t)
+		if scl[x].l == gpio.High && gap < high {
+			t.Fatalf("#%d: SCL high for %s", x, gap)
+		}
+		if scl[x].l == gpio.Low && (gap < low || gap >= high) {
+			t.Fatalf("#%d: SCL low for %s", x, gap)
+		}
+	}
+}
+
+func TestNew_OpenDrain(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+	clk := &fakeOpenDrainPin{fakePin: fakePin{w: b, clk: true}}
+	data := &fakeOpenDrainPin{fakePin: fakePin{w: b}}
+	i, err := New(clk, data, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.sclOpenDrain || !i.sdaOpenDrain {
+		t.Fatal("expected open-drain")
+	}
+	clk.ins, data.ins = 0, 0
+	r := make([]byte, 1)
+	if err := i.TxRepeatedStart(0x10, []byte{0x01}, r); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != 0x55 {
+		t.Fatalf("%#x", r[0])
+	}
+	expected := [][]byte{{0x20, 0x01}, {0x21}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	// The pins must never be switched to input.
+	if clk.ins != 0 || data.ins != 0 {
+		t.Fatalf("In() called %d and %d times", clk.ins, data.ins)
+	}
+}
+
+func TestTx_Released(t *testing.T) {
+	// Without open-drain support, the lines are released to go high and are
+	// never driven high.
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+	i := newFakeI2C(t, b)
+	b.pushPulls = 0
+	r := make([]byte, 1)
+	if err := i.TxRepeatedStart(0x10, []byte{0xFF}, r); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != 0x55 {
+		t.Fatalf("%#x", r[0])
+	}
+	if b.pushPulls != 0 {
+		t.Fatalf("lines driven high %d times", b.pushPulls)
+	}
+}
+
+func TestNew_OpenDrain_Unsupported(t *testing.T) {
+	b := &fakeWire{}
+	clk := &fakeOpenDrainPin{fakePin: fakePin{w: b, clk: true}, err: errors.New("not supported")}
+	i, err := New(clk, &fakePin{w: b}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.sclOpenDrain || i.sdaOpenDrain {
+		t.Fatal("expected emulation")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	defer registerFakePins(t, b)()
+	if err := Register("bitbang", "SCL", "SDA", physic.MegaHertz); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := i2creg.Unregister("bitbang"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	bus, err := i2creg.Open("bitbang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	if s := bus.String(); s != "bitbang/i2c(SCL, SDA)@1MHz" {
+		t.Fatal(s)
+	}
+	if err := bus.(*I2C).TxSequence(0x10, []Op{{Buf: []byte{0x01}}}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{{0x20, 0x01}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestRegister_Error(t *testing.T) {
+	defer registerFakePins(t, &fakeWire{})()
+	if err := Register("bitbang", "INVALID", "SDA", physic.MegaHertz); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Fatal(err)
+	}
+	if err := Register("bitbang", "SCL", "INVALID", physic.MegaHertz); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Fatal(err)
+	}
+	if err := Register("bitbang", "SCL", "SDA", 0); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+	i := newFakeI2C(t, b)
+	var lines []string
+	i.SetLogger(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+	r := make([]byte, 1)
+	if err := i.TxRepeatedStart(0x10, []byte{0xA5}, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"bitbang-i2c: START",
+		"bitbang-i2c: write 0x20 ACK",
+		"bitbang-i2c: write 0xA5 ACK",
+		"bitbang-i2c: START",
+		"bitbang-i2c: write 0x21 ACK",
+		"bitbang-i2c: read 0x55 NACK",
+		"bitbang-i2c: STOP",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("unexpected log\n%q\n%q", lines, expected)
+	}
+	i.SetLogger(nil)
+	lines = nil
+	if err := i.TxSequence(0x10, []Op{{Buf: []byte{0x01}}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Fatal(lines)
+	}
+}
+
+func TestTxAt(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return len(f) == 2 }}}
+	i := newFakeI2C(t, b)
+	var during []time.Duration
+	i.SetLogger(func(format string, args ...interface{}) {
+		during = append(during, i.halfCycle)
+	})
+	err := i.TxAt(100*physic.KiloHertz, 0x10, []byte{0x01}, nil)
+	if _, ok := err.(*NACKError); !ok {
+		t.Fatal(err)
+	}
+	if len(during) == 0 || during[0] != 5*time.Microsecond {
+		t.Fatal(during)
+	}
+	// The speed is restored even on error.
+	if i.halfCycle != 500*time.Nanosecond {
+		t.Fatal(i.halfCycle)
+	}
+	if err := i.TxAt(0, 0x10, nil, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNew_NeedsExternalPullups(t *testing.T) {
+	if i := newFakeI2C(t, &fakeWire{}); i.NeedsExternalPullups() {
+		t.Fatal("unexpected")
+	}
+	// SDA stays low even with the pull-up enabled.
+	if i := newFakeI2C(t, &fakeWire{hold: -1}); !i.NeedsExternalPullups() {
+		t.Fatal("expected external pull-ups to be required")
+	}
+}
+
+func TestNew_ReadsBack(t *testing.T) {
+	if i := newFakeI2C(t, &fakeWire{}); !i.ReadsBack() {
+		t.Fatal("expected the lines to read back")
+	}
+	b := &fakeWire{}
+	i, err := New(&fakeBlindPin{fakePin{w: b, clk: true}}, &fakePin{w: b}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.ReadsBack() {
+		t.Fatal("expected SCL to not read back")
+	}
+}
+
+func TestSetBlind(t *testing.T) {
+	// The slave doesn't acknowledge anything but the master can't tell.
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return true }}}
+	i, err := New(&fakeBlindPin{fakePin{w: b, clk: true}}, &fakeBlindPin{fakePin{w: b}}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Tx(0x10, []byte{0xA5}, nil); err != ErrBusBusy {
+		t.Fatal(err)
+	}
+	i.SetBlind(true)
+	if err := i.Tx(0x10, []byte{0xA5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Both bytes were sent even though the slave didn't acknowledge them.
+	if expected := [][]byte{{0x10 << 1, 0xA5}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if err := i.Tx(0x10, nil, make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "blind") {
+		t.Fatal(err)
+	}
+	if !b.scl || !b.sda {
+		t.Fatal("expected the bus to be idle")
+	}
+}
+
+func TestCheckWiring(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	if err := i.CheckWiring(); err != nil {
+		t.Fatal(err)
+	}
+	if !b.scl || !b.sda {
+		t.Fatal("expected the bus to be idle")
+	}
+	// The slave only saw a START then a STOP.
+	if expected := [][]byte{nil}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.CheckWiring(); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWiring_SCLStuckLow(t *testing.T) {
+	b := &fakeWire{}
+	clk := &fakeNoisyPin{fakePin: fakePin{w: b, clk: true}, levels: []gpio.Level{gpio.Low}, cycle: true}
+	i, err := New(clk, &fakePin{w: b}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.CheckWiring(); err == nil || !strings.Contains(err.Error(), "swapped") {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWiring_SDAStuckLow(t *testing.T) {
+	i := newFakeI2C(t, &fakeWire{hold: -1})
+	if err := i.CheckWiring(); err == nil || !strings.Contains(err.Error(), "SDA") {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWiring_Shorted(t *testing.T) {
+	i := newFakeI2C(t, &fakeWire{shorted: true})
+	if err := i.CheckWiring(); err == nil || !strings.Contains(err.Error(), "shorted") {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_InvalidPins(t *testing.T) {
+	b := &fakeWire{}
+	p := &fakePin{w: b, clk: true}
+	if _, err := New(p, p, physic.MegaHertz); err == nil || !strings.Contains(err.Error(), "different pins") {
+		t.Fatal(err)
+	}
+	if _, err := New(nil, p, physic.MegaHertz); err == nil {
+		t.Fatal("expected error")
+	}
+	bad := &fakePin{w: b, inErr: errors.New("no input")}
+	if _, err := New(p, bad, physic.MegaHertz); err == nil || !strings.Contains(err.Error(), "no input") {
+		t.Fatal(err)
+	}
+}
+
+func TestSetLogger_String(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	var lines []string
+	// The logger is called with the mutex held.
+	i.SetLogger(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf("%s: "+format, append([]interface{}{i}, args...)...))
+	})
+	if err := i.Tx(0x10, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) == 0 || lines[0] != "bitbang/i2c(SCL, SDA)@1MHz: bitbang-i2c: START" {
+		t.Fatal(lines)
+	}
+}
+
+func TestSetLogger_NoPullUp(t *testing.T) {
+	b := &fakeWire{}
+	i, err := New(&fakePin{w: b, clk: true}, &fakePin{w: b, pull: gpio.Float}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	i.SetLogger(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+	if len(lines) != 1 || !strings.Contains(lines[0], "SDA") {
+		t.Fatal(lines)
+	}
+}
+
+func TestTx_OutError(t *testing.T) {
+	for _, n := range []int{0, 1, 5, 38} {
+		b := &fakeWire{slave: &fakeSlave{tx: []byte{0x55}}}
+		clk := &fakePin{w: b, clk: true}
+		i, err := New(clk, &fakePin{w: b}, physic.MegaHertz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clk.outErr = errors.New("pin closed")
+		clk.failAfter = clk.outs + n
+		err = i.TxRepeatedStart(0x10, []byte{0x01}, make([]byte, 1))
+		if err != clk.outErr {
+			t.Fatalf("after %d: %v", n, err)
+		}
+	}
+}
+
+func TestPins(t *testing.T) {
+	b := &fakeWire{}
+	clk := &fakePin{w: b, clk: true}
+	data := &fakePin{w: b}
+	i, err := New(clk, data, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	p := i.Pins()
+	if len(p) != 2 || p[0] != clk || p[1] != data {
+		t.Fatal(p)
+	}
+	if i.SCL() != clk || i.SDA() != data {
+		t.Fatal(i.SCL(), i.SDA())
+	}
+	// Modifying the slice doesn't affect the bus.
+	p[0] = nil
+	if i.Pins()[0] != clk {
+		t.Fatal("expected a copy")
+	}
+}
+
+func TestClose(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	clk := &fakePin{w: b, clk: true}
+	data := &fakePin{w: b}
+	i, err := New(clk, data, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	clk.inPulls, data.inPulls = nil, nil
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []gpio.Pull{gpio.Float}
+	if !reflect.DeepEqual(clk.inPulls, expected) || !reflect.DeepEqual(data.inPulls, expected) {
+		t.Fatal(clk.inPulls, data.inPulls)
+	}
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if err := i.Recover(); err != ErrClosed {
+		t.Fatal(err)
+	}
+	// Closing again doesn't touch the pins.
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(clk.inPulls) != 1 || len(data.inPulls) != 1 {
+		t.Fatal(clk.inPulls, data.inPulls)
+	}
+}
+
+func TestNew_Shared(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	clk := &fakePin{w: b, clk: true}
+	data := &fakePin{w: b}
+	i1, err := New(clk, data, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.inPulls, data.inPulls = nil, nil
+	i2, err := New(clk, data, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i1 != i2 {
+		t.Fatal("expected the same bus")
+	}
+	// The pins were not configured again.
+	if len(clk.inPulls) != 0 || len(data.inPulls) != 0 {
+		t.Fatal(clk.inPulls, data.inPulls)
+	}
+	// The first Close only releases a reference.
+	if err := i1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(clk.inPulls) != 0 || len(data.inPulls) != 0 {
+		t.Fatal(clk.inPulls, data.inPulls)
+	}
+	if err := i2.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	clk.inPulls, data.inPulls = nil, nil
+	if err := i2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []gpio.Pull{gpio.Float}
+	if !reflect.DeepEqual(clk.inPulls, expected) || !reflect.DeepEqual(data.inPulls, expected) {
+		t.Fatal(clk.inPulls, data.inPulls)
+	}
+	if err := i2.Tx(0x10, []byte{0x01}, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+	// Once closed, New opens a new bus.
+	i3, err := New(clk, data, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i3.Close()
+	if i3 == i1 {
+		t.Fatal("expected a new bus")
+	}
+}
+
+func TestNew_SharedConflict(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	clk := &fakePin{w: b, clk: true}
+	data := &fakePin{w: b}
+	i, err := New(clk, data, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	if _, err := New(clk, data, 100*physic.KiloHertz); err == nil {
+		t.Fatal("expected error on another speed")
+	}
+	if _, err := New(data, clk, physic.MegaHertz); err == nil {
+		t.Fatal("expected error on swapped pins")
+	}
+	if _, err := New(clk, &fakePin{w: b}, physic.MegaHertz); err == nil {
+		t.Fatal("expected error on a pin already used")
+	}
+	// The failed calls didn't take a reference.
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Tx(0x10, nil, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_SharedAlias(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	defer registerFakePins(t, b)()
+	for _, a := range [][2]string{{"BB_SCL", "SCL"}, {"BB_SDA", "SDA"}} {
+		if err := gpioreg.RegisterAlias(a[0], a[1]); err != nil {
+			t.Fatal(err)
+		}
+		defer gpioreg.Unregister(a[0])
+	}
+	// gpioreg.ByName returns a new alias on each call.
+	i1, err := New(gpioreg.ByName("BB_SCL"), gpioreg.ByName("BB_SDA"), physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err := New(gpioreg.ByName("BB_SCL"), gpioreg.ByName("SDA"), physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i1 != i2 {
+		t.Fatal("expected the same bus")
+	}
+	if _, err := New(gpioreg.ByName("BB_SDA"), gpioreg.ByName("BB_SCL"), physic.MegaHertz); err == nil {
+		t.Fatal("expected error on swapped pins")
+	}
+	if err := i1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := buses[newBusKey(gpioreg.ByName("BB_SCL"), gpioreg.ByName("BB_SDA"))]; ok {
+		t.Fatal("expected the bus to be unregistered")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return f[0] != 0x20 }}}
+	i := newFakeI2C(t, b)
+	if ok, err := i.Probe(0x10); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if ok, err := i.Probe(0x11); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	expected := [][]byte{{0x20}, {0x22}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if b.slave.stops != 2 {
+		t.Fatalf("stops=%d", b.slave.stops)
+	}
+	if _, err := i.Probe(0x400); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestProbe_10bits(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	if ok, err := i.Probe(0x3A5); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	expected := [][]byte{{0xF6, 0xA5}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestProbe_BusBusy(t *testing.T) {
+	i := newFakeI2C(t, &fakeWire{slave: &fakeSlave{}, hold: -1})
+	if _, err := i.Probe(0x10); err != ErrBusBusy {
+		t.Fatal(err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return f[0] != 0x0B<<1 && f[0] != 0x3C<<1 }}}
+	i := newFakeI2C(t, b)
+	addrs, err := i.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []uint16{0x0B, 0x3C}; !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("%#v != %#v", addrs, expected)
+	}
+	if n := len(b.slave.frames); n != 0x77-0x08+1 {
+		t.Fatalf("probed %d addresses", n)
+	}
+	if f := b.slave.frames; f[0][0] != 0x08<<1 || f[len(f)-1][0] != 0x77<<1 {
+		t.Fatalf("%#v", f)
+	}
+}
+
+func TestHalt(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	// Block the transaction after the address byte until Halt is called.
+	reached := make(chan struct{})
+	blocked := false
+	i.SetLogger(func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "bitbang-i2c: write") && !blocked {
+			blocked = true
+			close(reached)
+			for atomic.LoadInt32(&i.halt) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	})
+	done := make(chan error)
+	go func() {
+		done <- i.Tx(0x10, []byte{0x01, 0x02}, nil)
+	}()
+	<-reached
+	if err := i.Halt(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrHalted {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{{0x10 << 1}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if !b.scl || !b.sda {
+		t.Fatal("expected the bus to be idle")
+	}
+	// The bus is still usable.
+	i.SetLogger(nil)
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendByte(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.SendStart(); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := i.SendByte(0x20); !ack || err != nil {
+		t.Fatal(ack, err)
+	}
+	if err := i.SendStop(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"D0", "C0",
+		// 0x20
+		"C1", "C0", "C1", "C0", "D1", "C1", "C0", "D0", "C1", "C0",
+		"C1", "C0", "C1", "C0", "C1", "C0", "C1", "C0",
+		// ACK, then the slave releases SDA and the master drives it low.
+		"C1", "C0", "D1", "D0",
+		// STOP
+		"C1", "D1",
+	}
+	if !reflect.DeepEqual(b.trace, expected) {
+		t.Fatalf("unexpected trace\n%v\n%v", b.trace, expected)
+	}
+	if expected := [][]byte{{0x20}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestSendFrame(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.SendFrame([]byte{0x40, 0xC0, 0x3F}, true); err != nil {
+		t.Fatal(err)
+	}
+	// No address byte is sent.
+	if expected := [][]byte{{0x40, 0xC0, 0x3F}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if b.slave.starts != 1 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+	// START, 3x9 clocks then STOP.
+	if b.trace[0] != "D0" || b.trace[1] != "C0" {
+		t.Fatal(b.trace)
+	}
+	if n := strings.Count(strings.Join(b.trace, ""), "C1"); n != 3*9+1 {
+		t.Fatal(n, b.trace)
+	}
+	if end := b.trace[len(b.trace)-2:]; !reflect.DeepEqual(end, []string{"C1", "D1"}) {
+		t.Fatal(b.trace)
+	}
+}
+
+func TestSendFrame_NACK(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func(f []byte) bool { return len(f) == 2 }}}
+	i := newFakeI2C(t, b)
+	err := i.SendFrame([]byte{0x40, 0xC0, 0x3F}, true)
+	expected := &NACKError{Phase: "write", Index: 1, Value: 0xC0}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("%v != %v", err, expected)
+	}
+	if b.slave.stops != 1 {
+		t.Fatal(b.slave.stops)
+	}
+}
+
+func TestSendFrame_NoAck(t *testing.T) {
+	// Nothing drives SDA low on the ACK clock.
+	b := &fakeWire{}
+	i := newFakeI2C(t, b)
+	b.reset()
+	if err := i.SendFrame([]byte{0x88, 0x01}, false); err != nil {
+		t.Fatal(err)
+	}
+	bits := sampledBits(b.trace[2:])
+	if len(bits) != 2*9+1 {
+		t.Fatal(bits)
+	}
+	expected := []gpio.Level{
+		gpio.High, gpio.Low, gpio.Low, gpio.Low, gpio.High, gpio.Low, gpio.Low, gpio.Low, gpio.High,
+		gpio.Low, gpio.Low, gpio.Low, gpio.Low, gpio.Low, gpio.Low, gpio.Low, gpio.High, gpio.High,
+	}
+	if !reflect.DeepEqual(bits[:18], expected) {
+		t.Fatalf("%v != %v", bits[:18], expected)
+	}
+	if end := b.trace[len(b.trace)-2:]; !reflect.DeepEqual(end, []string{"C1", "D1"}) {
+		t.Fatal(b.trace)
+	}
+	if err := i.SendFrame(nil, false); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReceiveByte(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0xC3, 0x3C}}}
+	i := newFakeI2C(t, b)
+	if err := i.SendStart(); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := i.SendByte(0x10<<1 | 1); !ack || err != nil {
+		t.Fatal(ack, err)
+	}
+	if v, err := i.ReceiveByte(true); v != 0xC3 || err != nil {
+		t.Fatal(v, err)
+	}
+	if v, err := i.ReceiveByte(false); v != 0x3C || err != nil {
+		t.Fatal(v, err)
+	}
+	if err := i.SendStop(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []bool{true, false}; !reflect.DeepEqual(b.slave.acks, expected) {
+		t.Fatalf("%#v != %#v", b.slave.acks, expected)
+	}
+}
+
+func TestSendStart_Locked(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	i.mu.Lock()
+	done := make(chan error)
+	go func() {
+		done <- i.SendStart()
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected SendStart to wait for the lock")
+	case <-time.After(10 * time.Millisecond):
+	}
+	i.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := i.SendStop(); err != nil {
+		t.Fatal(err)
+	}
+	if b.slave.starts != 1 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+}
+
+func TestTxRetry(t *testing.T) {
+	// NACK the address twice.
+	nacks := 0
+	nack := func(f []byte) bool {
+		if len(f) == 1 && nacks < 2 {
+			nacks++
+			return true
+		}
+		return false
+	}
+	b := &fakeWire{slave: &fakeSlave{nack: nack}}
+	i := newFakeI2C(t, b)
+	if err := i.TxRetry(0x10, []byte{0x01}, nil, 3, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if b.slave.starts != 3 {
+		t.Fatalf("starts=%d", b.slave.starts)
+	}
+}
+
+func TestTxRetry_Fail(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{nack: func([]byte) bool { return true }}}
+	i := newFakeI2C(t, b)
+	err := i.TxRetry(0x10, []byte{0x01}, nil, 2, time.Millisecond)
+	e, ok := err.(*RetryError)
+	if !ok || e.Attempts != 2 || !strings.Contains(err.Error(), "2 attempts") {
+		t.Fatal(err)
+	}
+	if n, ok := e.Err.(*NACKError); !ok || n.Phase != "address" {
+		t.Fatal(e.Err)
+	}
+	if err := i.TxRetry(0x10, nil, nil, 0, 0); err == nil {
+		t.Fatal("expected error")
+	}
+	// Errors that won't go away are not retried.
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.TxRetry(0x10, []byte{0x01}, nil, 2, time.Millisecond); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestActualSpeed(t *testing.T) {
+	b := &fakeWire{}
+	i := newFakeI2C(t, b)
+	i.delay = sleep
+	if err := i.SetSpeed(100 * physic.Hertz); err != nil {
+		t.Fatal(err)
+	}
+	b.reset()
+	f := i.ActualSpeed()
+	if f <= 0 || f > 100*physic.Hertz {
+		t.Fatal(f)
+	}
+	if len(b.trace) != 0 {
+		t.Fatal(b.trace)
+	}
+	// The measurement is cached.
+	if f2 := i.ActualSpeed(); f2 != f {
+		t.Fatal(f, f2)
+	}
+	if err := i.SetSpeed(physic.MegaHertz); err != nil {
+		t.Fatal(err)
+	}
+	if i.actualSpeed != 0 {
+		t.Fatal("expected the measurement to be reset")
+	}
+}
+
+func TestActualSpeed_FakeClock(t *testing.T) {
+	b := &fakeWire{}
+	i := newFakeI2C(t, b)
+	// Each call advances the clock by 9ms, so the 9 measured cycles last 1ms
+	// each.
+	now := time.Unix(0, 0)
+	i.now = func() time.Time {
+		now = now.Add(9 * time.Millisecond)
+		return now
+	}
+	if f := i.ActualSpeed(); f != physic.KiloHertz {
+		t.Fatal(f)
+	}
+	// A clock that doesn't advance doesn't divide by zero.
+	i.now = func() time.Time { return now }
+	if err := i.SetSpeed(physic.MegaHertz); err != nil {
+		t.Fatal(err)
+	}
+	if f := i.ActualSpeed(); f <= 0 {
+		t.Fatal(f)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	b := &fakeWire{}
+	i := newFakeI2C(t, b)
+	// Sleeping takes 50µs longer than asked, busy looping is exact.
+	now := time.Unix(0, 0)
+	i.now = func() time.Time { return now }
+	i.sleepFn = func(d time.Duration) { now = now.Add(d + 50*time.Microsecond) }
+	i.spin = func(d time.Duration) { now = now.Add(d) }
+	if g := i.Calibrate(); g != 51*time.Microsecond {
+		t.Fatal(g)
+	}
+	for _, f := range []physic.Frequency{physic.KiloHertz, 10 * physic.KiloHertz, 100 * physic.KiloHertz} {
+		if err := i.SetSpeed(f); err != nil {
+			t.Fatal(err)
+		}
+		start := now
+		i.delay(i.halfCycle)
+		if d := now.Sub(start); d != f.Period()/2 {
+			t.Fatalf("%s: %s", f, d)
+		}
+		if a := i.ActualSpeed(); a != f {
+			t.Fatalf("%s: %s", f, a)
+		}
+	}
+}
+
+func TestSetNACKPolicy(t *testing.T) {
+	if err := newFakeI2C(t, &fakeWire{}).SetNACKPolicy(NACKPolicy(2)); err == nil {
+		t.Fatal("expected error")
+	}
+	w := []byte{0x00, 0x01, 0x02, 0x03}
+	nack := func(f []byte) bool { return len(f) == 4 }
+	// Abort stops on the byte not acknowledged.
+	b := &fakeWire{slave: &fakeSlave{nack: nack}}
+	i := newFakeI2C(t, b)
+	err := i.Tx(0x10, w, nil)
+	if e, ok := err.(*NACKError); !ok || e.Index != 2 {
+		t.Fatal(err)
+	}
+	if expected := [][]byte{{0x20, 0x00, 0x01, 0x02}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	// Continue writes all the bytes.
+	b = &fakeWire{slave: &fakeSlave{nack: nack}}
+	i = newFakeI2C(t, b)
+	if err := i.SetNACKPolicy(NACKContinue); err != nil {
+		t.Fatal(err)
+	}
+	err = i.Tx(0x10, w, nil)
+	expected := &NACKsError{NACKs: []NACKError{{Phase: "write", Index: 2, Value: 0x02}}}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("%#v != %#v", err, expected)
+	}
+	if s := err.Error(); s != "bitbang-i2c: got NACK on write bytes 2 (0x02)" {
+		t.Fatal(s)
+	}
+	if expected := [][]byte{{0x20, 0x00, 0x01, 0x02, 0x03}}; !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if b.slave.stops != 1 {
+		t.Fatal(b.slave.stops)
+	}
+	if !isRetryable(err) {
+		t.Fatal("expected retryable")
+	}
+}
+
+func TestSetDiagnostics(t *testing.T) {
+	data := []struct {
+		stretch  int
+		expected Diagnostics
+	}{
+		// SCL reads low once after each release.
+		{2, Diagnostics{RiseTimeNeeded: true}},
+		// SCL reads low three times after each release, so two half-cycles
+		// are waited for each of the 9 clocks.
+		{4, Diagnostics{StretchCycles: 18}},
+	}
+	for _, line := range data {
+		for _, enable := range []bool{false, true} {
+			b := &fakeWire{slave: &fakeSlave{tx: []byte{0xC3}}}
+			i := newFakeI2C(t, b)
+			i.SetDiagnostics(enable)
+			i.start()
+			if ack, err := i.writeByte(0x10<<1 | 1); !ack || err != nil {
+				t.Fatal(ack, err)
+			}
+			// The slave only stretches the clock while sending.
+			b.mu.Lock()
+			b.stretch = line.stretch
+			b.mu.Unlock()
+			if v, err := i.readByte(true); v != 0xC3 || err != nil {
+				t.Fatal(v, err)
+			}
+			expected := Diagnostics{}
+			if enable {
+				expected = line.expected
+			}
+			if d := i.LastDiagnostics(); d != expected {
+				t.Fatalf("%d, %t: %#v != %#v", line.stretch, enable, d, expected)
+			}
+		}
+	}
+}
+
+func TestSetSampleVotes(t *testing.T) {
+	b := &fakeWire{}
+	i := newFakeI2C(t, b)
+	for _, n := range []int{0, 2, -1} {
+		if err := i.SetSampleVotes(n); err == nil {
+			t.Fatalf("%d: expected error", n)
+		}
+	}
+	if err := i.SetSampleVotes(3); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		levels   []gpio.Level
+		expected gpio.Level
+	}{
+		{[]gpio.Level{gpio.High, gpio.Low, gpio.High}, gpio.High},
+		{[]gpio.Level{gpio.Low, gpio.High, gpio.Low}, gpio.Low},
+		{[]gpio.Level{gpio.High, gpio.High, gpio.High}, gpio.High},
+	}
+	for _, line := range data {
+		p := &fakeNoisyPin{fakePin: fakePin{w: b}, levels: line.levels}
+		i.sda = p
+		if l := i.sampleSDA(); l != line.expected {
+			t.Fatalf("%v: %s", line.levels, l)
+		}
+		if len(p.levels) != 0 {
+			t.Fatal("expected 3 reads")
+		}
+	}
+}
+
+func TestSetSampleVotes_Tx(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0xC3}}}
+	i := newFakeI2C(t, b)
+	if err := i.SetSampleVotes(5); err != nil {
+		t.Fatal(err)
+	}
+	r := make([]byte, 1)
+	if err := i.TxRepeatedStart(0x10, []byte{0x01}, r); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != 0xC3 {
+		t.Fatalf("%#x", r[0])
+	}
+}
+
+func TestSetACKTimeout(t *testing.T) {
+	// The slave never releases SCL during the ACK.
+	b := &fakeWire{slave: &fakeSlave{}, stretch: -1, stretchAt: 9}
+	i := newFakeI2C(t, b)
+	i.SetClockStretchTimeout(10 * time.Second)
+	i.SetACKTimeout(10 * time.Millisecond)
+	start := time.Now()
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != ErrACKTimeout {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected duration %s", d)
+	}
+}
+
+func TestSetACKTimeout_NoStop(t *testing.T) {
+	// The slave holds SCL low from the ACK on, so no STOP can be issued.
+	b := &fakeWire{slave: &fakeSlave{}, stretch: -1, stretchFrom: 9}
+	i := newFakeI2C(t, b)
+	i.SetClockStretchTimeout(10 * time.Second)
+	i.SetACKTimeout(10 * time.Millisecond)
+	start := time.Now()
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != ErrACKTimeout {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected duration %s", d)
+	}
+	if b.slave.stops != 0 {
+		t.Fatal(b.slave.stops)
+	}
+}
+
+func TestSetACKTimeout_Indeterminate(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	if err := i.SetSampleVotes(3); err != nil {
+		t.Fatal(err)
+	}
+	i.SetACKTimeout(10 * time.Millisecond)
+	// SDA alternates forever.
+	i.sda = &fakeNoisyPin{fakePin: fakePin{w: b}, levels: []gpio.Level{gpio.High, gpio.Low}, cycle: true}
+	if _, err := i.writeByte(0x20); err != ErrACKTimeout {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkWriteByte(b *testing.B) {
+	i := newBenchI2C(b)
+	if err := i.start(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := i.writeByte(0xA5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadByte(b *testing.B) {
+	i := newBenchI2C(b)
+	if err := i.start(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := i.readByte(false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTx(b *testing.B) {
+	i := newBenchI2C(b)
+	w := []byte{0x01, 0x02}
+	r := make([]byte, 2)
+	b.SetBytes(int64(len(w) + len(r)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := i.Tx(0x10, w, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//
+
+// newFakeI2C returns an I2C connected to a fakeWire.
+//
+// The delays are skipped so the tests are fast; the tests measuring time set
+// i.delay back to sleep.
+func newFakeI2C(t *testing.T, b *fakeWire) *I2C {
+	i, err := New(&fakePin{w: b, clk: true}, &fakePin{w: b}, physic.MegaHertz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.delay = func(d time.Duration) {}
+	return i
+}
+
+// registerFakePins registers the fakePin "SCL" and "SDA" of b in gpioreg and
+// returns a function to unregister them.
+func registerFakePins(t *testing.T, b *fakeWire) func() {
+	if err := gpioreg.Register(&fakePin{w: b, clk: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gpioreg.Register(&fakePin{w: b}); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		for _, n := range []string{"SCL", "SDA"} {
+			if err := gpioreg.Unregister(n); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+// newBenchI2C returns an I2C connected to a benchWire and without any delay,
+// to measure the overhead of the loops.
+func newBenchI2C(b *testing.B) *I2C {
+	w := &benchWire{}
+	i, err := New(&benchPin{fakePin: fakePin{clk: true}, bw: w}, &benchPin{bw: w}, physic.MegaHertz)
+	if err != nil {
+		b.Fatal(err)
+	}
+	i.delay = func(d time.Duration) {}
+	return i
+}
+
+// benchWire is a minimal simulation of a bus with a slave that acknowledges
+// every byte and sends 0xFF. Unlike fakeWire, it doesn't allocate.
+type benchWire struct {
+	scl, sda gpio.Level
+	clocks   int // SCL rising edges since the last START or STOP.
+}
+
+// benchPin is one of the two lines of a benchWire.
+type benchPin struct {
+	fakePin
+	bw *benchWire
+}
+
+func (p *benchPin) In(pull gpio.Pull, edge gpio.Edge) error {
+	return p.Out(gpio.High)
+}
+
+func (p *benchPin) Read() gpio.Level {
+	if p.clk {
+		return p.bw.scl
+	}
+	if p.bw.scl && p.bw.clocks%9 == 0 && p.bw.clocks != 0 {
+		// ACK slot.
+		return gpio.Low
+	}
+	return p.bw.sda
+}
+
+func (p *benchPin) Out(l gpio.Level) error {
+	w := p.bw
+	if p.clk {
+		if l && !w.scl {
+			w.clocks++
+		}
+		w.scl = l
+		return nil
+	}
+	if w.scl && l != w.sda {
+		// START or STOP.
+		w.clocks = 0
+	}
+	w.sda = l
+	return nil
+}
+
+// fakeWire simulates the two open-drain lines of an I²C bus shared between
+// the master under test and a single fakeSlave.
+//
+// A line is high only when neither side pulls it low.
+type fakeWire struct {
+	mu    sync.Mutex
+	sclM  gpio.Level // Master drive; High means released.
+	sdaM  gpio.Level
+	sclS  gpio.Level // Slave drive; High means released.
+	sdaS  gpio.Level
+	scl   gpio.Level // Effective level.
+	sda   gpio.Level
+	init  bool
+	trace []string // Effective level transitions, "C0", "C1", "D0", "D1".
+	slave *fakeSlave
+	// stretch is the number of SCL reads during which the slave holds SCL low
+	// after the master released it. -1 means forever.
+	stretch     int
+	stretchLeft int
+	// stretchAt is the only release of SCL stretched, counting from 1. 0
+	// means every release.
+	stretchAt int
+	// stretchFrom, when not 0, is the first release of SCL stretched, counting
+	// from 1; every following release is stretched too.
+	stretchFrom int
+	releases    int
+	// hold is the number of SCL clocks during which SDA is held low by a
+	// confused slave. -1 means forever.
+	hold int
+	// contendAt is the SCL clock at which another master starts pulling SDA
+	// low. 0 means never.
+	contendAt int
+	rises     int
+	// earlyReads is the number of SDA reads while SCL was low.
+	earlyReads int
+	// drives records when the master changed a line.
+	drives []fakeDrive
+	// shorted means SCL and SDA are shorted together.
+	shorted bool
+	// sclPP and sdaPP are set while the master drives the line high
+	// push-pull, so that it reads high even if pulled low by someone else.
+	sclPP bool
+	sdaPP bool
+	// contention is set when a line driven high push-pull was pulled low.
+	contention bool
+	// pushPulls is the number of times the master drove a line high
+	// push-pull.
+	pushPulls int
+}
+
+// fakeDrive is a line change by the master.
+type fakeDrive struct {
+	clk bool
+	l   gpio.Level
+	t   time.Time
+}
+
+// reset clears the trace.
+func (w *fakeWire) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.trace = nil
+	w.rises = 0
+	w.drives = nil
+}
+
+// drive is called with the lock held when the master changes a line.
+func (w *fakeWire) drive(clk bool, l gpio.Level) {
+	if !w.init {
+		w.init = true
+		w.sclM, w.sdaM, w.sclS, w.sdaS = gpio.High, gpio.High, gpio.High, gpio.High
+		w.scl, w.sda = gpio.High, gpio.High
+	}
+	w.drives = append(w.drives, fakeDrive{clk, l, time.Now()})
+	if clk {
+		released := l && !w.sclM
+		if released {
+			w.releases++
+		}
+		w.sclM = l
+		w.sclS = gpio.High
+		if bool(released) && w.stretch != 0 && w.stretchesRelease() {
+			w.sclS = gpio.Low
+			w.stretchLeft = w.stretch
+		}
+	} else {
+		w.sdaM = l
+	}
+	w.update()
+}
+
+// stretchesRelease returns true if the current release of SCL is stretched.
+func (w *fakeWire) stretchesRelease() bool {
+	if w.stretchFrom != 0 {
+		return w.releases >= w.stretchFrom
+	}
+	return w.stretchAt == 0 || w.releases == w.stretchAt
+}
+
+// setPushPull is called with the lock held to tell if the master drives a
+// line high push-pull.
+func (w *fakeWire) setPushPull(clk, pp bool) {
+	if pp {
+		w.pushPulls++
+	}
+	if clk {
+		w.sclPP = pp
+	} else {
+		w.sdaPP = pp
+	}
+}
+
+// update recomputes the effective levels and lets the slave react to edges.
+func (w *fakeWire) update() {
+	for {
+		scl := w.sclM && w.sclS
+		sda := w.sdaM && w.sdaS && w.hold == 0 && (w.contendAt == 0 || w.rises < w.contendAt)
+		if w.sclPP && scl == gpio.Low {
+			w.contention = true
+			scl = gpio.High
+		}
+		if w.sdaPP && sda == gpio.Low {
+			w.contention = true
+			sda = gpio.High
+		}
+		if w.shorted {
+			scl = scl && sda
+			sda = scl
+		}
+		if scl != w.scl {
+			w.scl = scl
+			if scl {
+				w.rises++
+				if w.hold > 0 {
+					w.hold--
+				}
+			}
+			w.trace = append(w.trace, "C"+levelStr(scl))
+			if w.slave != nil {
+				w.slave.onSCL(w, scl)
+			}
+			continue
+		}
+		if sda != w.sda {
+			w.sda = sda
+			w.trace = append(w.trace, "D"+levelStr(sda))
+			if w.slave != nil && w.scl {
+				if sda {
+					w.slave.onStop(w)
+				} else {
+					w.slave.onStart(w)
+				}
+			}
+			continue
+		}
+		return
+	}
+}
+
+// sampledBits returns the SDA level on each rising edge of SCL in a trace
+// starting with both lines low.
+func sampledBits(trace []string) []gpio.Level {
+	var out []gpio.Level
+	sda := gpio.Low
+	for _, e := range trace {
+		switch e {
+		case "D0", "D1":
+			sda = e == "D1"
+		case "C1":
+			out = append(out, sda)
+		}
+	}
+	return out
+}
+
+func levelStr(l gpio.Level) string {
+	if l {
+		return "1"
+	}
+	return "0"
+}
+
+// fakeSlave is a minimal I²C slave state machine.
+type fakeSlave struct {
+	// nack returns true if the last byte in the current frame shall not be
+	// acknowledged. The slice contains all the bytes received since the last
+	// START. nil means every byte is acknowledged.
+	nack func(frame []byte) bool
+	// tx is the data to send when addressed for a read.
+	tx []byte
+
+	// Observed.
+	frames [][]byte // Bytes received, one slice per START.
+	acks   []bool   // ACK from the master on each byte sent.
+	starts int
+	stops  int
+
+	active   bool
+	sending  bool
+	ackSlot  bool // The 9th clock is in progress.
+	bit      int
+	cur      byte
+	lastNACK bool
+}
+
+func (s *fakeSlave) onStart(w *fakeWire) {
+	s.starts++
+	s.active = true
+	s.sending = false
+	s.ackSlot = false
+	s.bit = 0
+	s.cur = 0
+	s.frames = append(s.frames, nil)
+	w.sdaS = gpio.High
+}
+
+func (s *fakeSlave) onStop(w *fakeWire) {
+	s.stops++
+	s.active = false
+	w.sdaS = gpio.High
+}
+
+func (s *fakeSlave) onSCL(w *fakeWire, l gpio.Level) {
+	if !s.active {
+		return
+	}
+	if l {
+		// Rising edge: sample.
+		if s.ackSlot {
+			if s.sending {
+				s.acks = append(s.acks, !bool(w.sda))
+				s.lastNACK = bool(w.sda)
+			}
+			return
+		}
+		if !s.sending {
+			s.cur = s.cur<<1 | byte(boolToInt(bool(w.sda)))
+		}
+		s.bit++
+		return
+	}
+	// Falling edge: drive.
+	if s.ackSlot {
+		s.ackSlot = false
+		s.bit = 0
+		w.sdaS = gpio.High
+		if s.sending {
+			if s.lastNACK {
+				s.active = false
+				return
+			}
+			s.driveBit(w)
+			return
+		}
+		f := s.frames[len(s.frames)-1]
+		if len(f) == 1 && f[0]&1 == 1 && len(s.tx) != 0 && !s.lastNACK {
+			// Addressed for a read.
+			s.sending = true
+			s.driveBit(w)
+		}
+		return
+	}
+	if s.bit == 8 {
+		s.ackSlot = true
+		if s.sending {
+			w.sdaS = gpio.High
+			return
+		}
+		i := len(s.frames) - 1
+		s.frames[i] = append(s.frames[i], s.cur)
+		s.cur = 0
+		s.lastNACK = s.nack != nil && s.nack(s.frames[i])
+		if !s.lastNACK {
+			w.sdaS = gpio.Low
+		}
+		return
+	}
+	if s.sending {
+		s.driveBit(w)
+	}
+}
+
+// driveBit drives the next bit to send on SDA.
+func (s *fakeSlave) driveBit(w *fakeWire) {
+	// Release the line when there is nothing left to send.
+	b := byte(0xFF)
+	if len(s.tx) != 0 {
+		b = s.tx[0]
+	}
+	w.sdaS = gpio.Level(b&(0x80>>uint(s.bit)) != 0)
+	if s.bit == 7 && len(s.tx) != 0 {
+		s.tx = s.tx[1:]
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fakePin is one of the two lines of a fakeWire.
+type fakePin struct {
+	w     *fakeWire
+	clk   bool
+	inErr error     // Returned by In.
+	pull  gpio.Pull // Returned by Pull, if not PullNoChange.
+	// outErr is returned by Out once it was called failAfter times.
+	outErr    error
+	outs      int
+	failAfter int
+	inPulls   []gpio.Pull // Pulls passed to In.
+	openDrain bool        // Out(gpio.High) releases the line.
+}
+
+func (p *fakePin) String() string {
+	return p.Name()
+}
+
+func (p *fakePin) Halt() error {
+	return nil
+}
+
+func (p *fakePin) Name() string {
+	if p.clk {
+		return "SCL"
+	}
+	return "SDA"
+}
+
+func (p *fakePin) Number() int {
+	return -1
+}
+
+func (p *fakePin) Function() string {
+	return ""
+}
+
+func (p *fakePin) In(pull gpio.Pull, edge gpio.Edge) error {
+	if p.inErr != nil {
+		return p.inErr
+	}
+	p.inPulls = append(p.inPulls, pull)
+	p.w.mu.Lock()
+	defer p.w.mu.Unlock()
+	p.w.setPushPull(p.clk, false)
+	p.w.drive(p.clk, gpio.High)
+	return nil
+}
+
+func (p *fakePin) Read() gpio.Level {
+	p.w.mu.Lock()
+	defer p.w.mu.Unlock()
+	if p.clk {
+		if !p.w.sclS && p.w.stretchLeft > 0 {
+			if p.w.stretchLeft--; p.w.stretchLeft == 0 {
+				p.w.sclS = gpio.High
+				p.w.update()
+			}
+		}
+		return p.w.scl
+	}
+	if !p.w.scl {
+		p.w.earlyReads++
+	}
+	return p.w.sda
+}
+
+func (p *fakePin) WaitForEdge(timeout time.Duration) bool {
+	return false
+}
+
+func (p *fakePin) Pull() gpio.Pull {
+	if p.pull != gpio.PullNoChange {
+		return p.pull
+	}
+	return gpio.PullUp
+}
+
+func (p *fakePin) DefaultPull() gpio.Pull {
+	return gpio.PullUp
+}
+
+func (p *fakePin) Out(l gpio.Level) error {
+	if p.outs++; p.outErr != nil && p.outs > p.failAfter {
+		return p.outErr
+	}
+	p.w.mu.Lock()
+	defer p.w.mu.Unlock()
+	// A pin is push-pull unless it is a true open-drain output.
+	p.w.setPushPull(p.clk, l == gpio.High && !p.openDrain)
+	p.w.drive(p.clk, l)
+	return nil
+}
+
+func (p *fakePin) PWM(duty gpio.Duty, f physic.Frequency) error {
+	return nil
+}
+
+var _ gpio.PinIO = &fakePin{}
+
+// samplingPin is a fakePin that records each Read in the trace of its wire as
+// "R".
+type samplingPin struct {
+	fakePin
+}
+
+func (p *samplingPin) Read() gpio.Level {
+	l := p.fakePin.Read()
+	p.w.mu.Lock()
+	p.w.trace = append(p.w.trace, "R")
+	p.w.mu.Unlock()
+	return l
+}
+
+// fakeNoisyPin returns levels on Read.
+type fakeNoisyPin struct {
+	fakePin
+	levels []gpio.Level
+	cycle  bool // Start over once all the levels were returned.
+}
+
+func (p *fakeNoisyPin) Read() gpio.Level {
+	l := p.levels[0]
+	p.levels = p.levels[1:]
+	if p.cycle {
+		p.levels = append(p.levels, l)
+	}
+	return l
+}
+
+// fakeBlindPin is a fakePin that always reads low, like an output only pin.
+type fakeBlindPin struct {
+	fakePin
+}
+
+func (p *fakeBlindPin) Read() gpio.Level {
+	return gpio.Low
+}
+
+// fakeOpenDrainPin is a fakePin that supports a true open-drain output.
+type fakeOpenDrainPin struct {
+	fakePin
+	err error // Returned by SetFunc.
+	ins int
+	fn  pin.Func
+}
+
+func (p *fakeOpenDrainPin) Func() pin.Func {
+	return p.fn
+}
+
+func (p *fakeOpenDrainPin) SupportedFuncs() []pin.Func {
+	return []pin.Func{gpio.IN, gpio.OUT, gpio.OUT_OC}
+}
+
+func (p *fakeOpenDrainPin) SetFunc(f pin.Func) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.fn = f
+	p.openDrain = f == gpio.OUT_OC
+	return nil
+}
+
+func (p *fakeOpenDrainPin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.ins++
+	return p.fakePin.In(pull, edge)
+}
+
+var _ pin.PinFunc = &fakeOpenDrainPin{}
@@ -0,0 +1,264 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Specification
+//
+// https://www.maximintegrated.com/en/app-notes/index.mvp/id/126
+
+package bitbang
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/onewire"
+	"periph.io/x/periph/host/cpu"
+)
+
+// NewOneWire returns an object that communicates 1-wire over a pin.
+//
+// The pin is driven as open-drain, like the I²C lines. It requires an external
+// pull-up, usually 4.7kΩ.
+func NewOneWire(data gpio.PinIO) (*OneWire, error) {
+	// The bus idles high.
+	if err := data.In(gpio.PullUp, gpio.NoEdge); err != nil {
+		return nil, err
+	}
+	o := &OneWire{q: data, openDrain: setOpenDrain(data), delay: cpu.Nanospin}
+	if o.openDrain {
+		if err := data.Out(gpio.High); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// OneWire represents a 1-wire master implemented as bit-banging on a GPIO pin.
+//
+// It uses the standard speed timings.
+type OneWire struct {
+	mu        sync.Mutex
+	q         gpio.PinIO
+	openDrain bool
+	delay     func(d time.Duration)
+}
+
+func (o *OneWire) String() string {
+	return fmt.Sprintf("bitbang/onewire(%s)", o.q)
+}
+
+// Close implements onewire.BusCloser.
+func (o *OneWire) Close() error {
+	return nil
+}
+
+// Tx implements onewire.Bus.
+//
+// It issues a reset, writes w then reads r. When power is
+// onewire.StrongPullup, the line is actively driven high afterward to power
+// the devices, until the next transaction.
+//
+// The strong pull-up is not supported when the pin is a true open-drain
+// output, as it can't drive the line high.
+func (o *OneWire) Tx(w, r []byte, power onewire.Pullup) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if power == onewire.StrongPullup && o.openDrain {
+		return fmt.Errorf("bitbang-onewire: strong pull-up is not supported on open-drain pin %s", o.q)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := o.reset(); err != nil {
+		return err
+	}
+	for _, b := range w {
+		if err := o.writeByte(b); err != nil {
+			return err
+		}
+	}
+	for x := range r {
+		var err error
+		if r[x], err = o.readByte(); err != nil {
+			return err
+		}
+	}
+	if power == onewire.StrongPullup {
+		return o.q.Out(gpio.High)
+	}
+	return nil
+}
+
+// Search implements onewire.Bus.
+func (o *OneWire) Search(alarmOnly bool) ([]onewire.Address, error) {
+	return onewire.Search(o, alarmOnly)
+}
+
+// SearchTriplet implements onewire.BusSearcher.
+//
+// It reads the bit and its complement, then writes the direction taken.
+//
+// SearchTriplet should not be used directly, use Search instead.
+func (o *OneWire) SearchTriplet(direction byte) (onewire.TripletResult, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// The devices pull the line low for the bit, then for its complement, so a
+	// 0 means at least one device has the value.
+	bit, err := o.readBit()
+	if err != nil {
+		return onewire.TripletResult{}, err
+	}
+	comp, err := o.readBit()
+	if err != nil {
+		return onewire.TripletResult{}, err
+	}
+	tr := onewire.TripletResult{GotZero: !bit, GotOne: !comp}
+	switch {
+	case tr.GotZero && tr.GotOne:
+		tr.Taken = direction & 1
+	case tr.GotOne:
+		tr.Taken = 1
+	}
+	if err := o.writeBit(tr.Taken == 1); err != nil {
+		return onewire.TripletResult{}, err
+	}
+	return tr, nil
+}
+
+// Q implements onewire.Pins.
+func (o *OneWire) Q() gpio.PinIO {
+	return o.q
+}
+
+//
+
+// Standard speed timings; the letter is the one used in the application note.
+const (
+	owWriteLow1      = 6 * time.Microsecond   // A; also the read low time.
+	owWriteRecovery1 = 64 * time.Microsecond  // B
+	owWriteLow0      = 60 * time.Microsecond  // C
+	owWriteRecovery0 = 10 * time.Microsecond  // D
+	owReadSample     = 9 * time.Microsecond   // E
+	owReadRecovery   = 55 * time.Microsecond  // F
+	owResetLow       = 480 * time.Microsecond // H
+	owPresenceSample = 70 * time.Microsecond  // I
+	owResetRecovery  = 410 * time.Microsecond // J
+)
+
+// reset issues a reset pulse and returns an error if no device responded with
+// a presence pulse.
+func (o *OneWire) reset() error {
+	if err := o.release(); err != nil {
+		return err
+	}
+	if o.q.Read() == gpio.Low {
+		return shortedBusError("bitbang-onewire: bus has a short")
+	}
+	if err := o.q.Out(gpio.Low); err != nil {
+		return err
+	}
+	o.delay(owResetLow)
+	if err := o.release(); err != nil {
+		return err
+	}
+	o.delay(owPresenceSample)
+	present := o.q.Read() == gpio.Low
+	o.delay(owResetRecovery)
+	if !present {
+		return noDevicesError("bitbang-onewire: no device present")
+	}
+	return nil
+}
+
+// writeByte writes the 8 bits least significant bit first.
+func (o *OneWire) writeByte(b byte) error {
+	for x := uint(0); x < 8; x++ {
+		if err := o.writeBit(b&(1<<x) != 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readByte reads 8 bits least significant bit first.
+func (o *OneWire) readByte() (byte, error) {
+	var b byte
+	for x := uint(0); x < 8; x++ {
+		bit, err := o.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			b |= 1 << x
+		}
+	}
+	return b, nil
+}
+
+// writeBit does a write time slot.
+func (o *OneWire) writeBit(bit bool) error {
+	if err := o.q.Out(gpio.Low); err != nil {
+		return err
+	}
+	if bit {
+		o.delay(owWriteLow1)
+		if err := o.release(); err != nil {
+			return err
+		}
+		o.delay(owWriteRecovery1)
+	} else {
+		o.delay(owWriteLow0)
+		if err := o.release(); err != nil {
+			return err
+		}
+		o.delay(owWriteRecovery0)
+	}
+	return nil
+}
+
+// readBit does a read time slot.
+func (o *OneWire) readBit() (bool, error) {
+	if err := o.q.Out(gpio.Low); err != nil {
+		return false, err
+	}
+	o.delay(owWriteLow1)
+	if err := o.release(); err != nil {
+		return false, err
+	}
+	o.delay(owReadSample)
+	bit := o.q.Read() == gpio.High
+	o.delay(owReadRecovery)
+	return bit, nil
+}
+
+// release releases the line so it is pulled high unless a device holds it
+// low.
+func (o *OneWire) release() error {
+	if o.openDrain {
+		return o.q.Out(gpio.High)
+	}
+	return o.q.In(gpio.PullUp, gpio.NoEdge)
+}
+
+// noDevicesError implements error and onewire.NoDevicesError.
+type noDevicesError string
+
+func (e noDevicesError) Error() string   { return string(e) }
+func (e noDevicesError) NoDevices() bool { return true }
+
+// shortedBusError implements error and onewire.ShortedBusError.
+type shortedBusError string
+
+func (e shortedBusError) Error() string   { return string(e) }
+func (e shortedBusError) IsShorted() bool { return true }
+func (e shortedBusError) BusError() bool  { return true }
+
+var _ onewire.Bus = &OneWire{}
+var _ onewire.BusCloser = &OneWire{}
+var _ onewire.BusSearcher = &OneWire{}
+var _ onewire.Pins = &OneWire{}
@@ -0,0 +1,361 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/onewire"
+	"periph.io/x/periph/conn/physic"
+)
+
+func TestOneWire_Reset(t *testing.T) {
+	b := &fakeOneWire{devices: []*fakeOneWireDevice{{}}}
+	o := newFakeOneWire(t, b)
+	if err := o.Tx(nil, nil, onewire.WeakPullup); err != nil {
+		t.Fatal(err)
+	}
+	if b.resets != 1 {
+		t.Fatalf("resets=%d", b.resets)
+	}
+}
+
+func TestOneWire_Reset_NoDevice(t *testing.T) {
+	o := newFakeOneWire(t, &fakeOneWire{})
+	err := o.Tx(nil, nil, onewire.WeakPullup)
+	if e, ok := err.(onewire.NoDevicesError); !ok || !e.NoDevices() {
+		t.Fatal(err)
+	}
+}
+
+func TestOneWire_Reset_Shorted(t *testing.T) {
+	o := newFakeOneWire(t, &fakeOneWire{shorted: true})
+	err := o.Tx(nil, nil, onewire.WeakPullup)
+	if e, ok := err.(onewire.ShortedBusError); !ok || !e.IsShorted() {
+		t.Fatal(err)
+	}
+}
+
+func TestOneWire_Tx(t *testing.T) {
+	d := &fakeOneWireDevice{scratch: []byte{0x50, 0x05, 0xA5}}
+	b := &fakeOneWire{devices: []*fakeOneWireDevice{d}}
+	o := newFakeOneWire(t, b)
+	// Skip ROM, then Read Scratchpad.
+	r := make([]byte, 3)
+	if err := o.Tx([]byte{0xCC, 0xBE}, r, onewire.StrongPullup); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, d.scratch) {
+		t.Fatalf("%#v != %#v", r, d.scratch)
+	}
+	if expected := []byte{0xBE}; !reflect.DeepEqual(d.rx, expected) {
+		t.Fatalf("%#v != %#v", d.rx, expected)
+	}
+	if !b.strong {
+		t.Fatal("expected strong pull-up")
+	}
+}
+
+func TestOneWire_Tx_OutError(t *testing.T) {
+	d := &fakeOneWireDevice{scratch: []byte{0x50, 0x05, 0xA5}}
+	b := &fakeOneWire{devices: []*fakeOneWireDevice{d}}
+	o := newFakeOneWire(t, b)
+	// The reset pulse succeeds, then a write time slot fails.
+	o.q.(*fakeOneWirePin).outErr = errors.New("pin closed")
+	o.q.(*fakeOneWirePin).failAfter = 3
+	if err := o.Tx([]byte{0xCC, 0xBE}, make([]byte, 3), onewire.WeakPullup); err == nil || err.Error() != "pin closed" {
+		t.Fatal(err)
+	}
+	if _, err := o.SearchTriplet(0); err == nil || err.Error() != "pin closed" {
+		t.Fatal(err)
+	}
+}
+
+func TestOneWire_Tx_StrongPullupOpenDrain(t *testing.T) {
+	b := &fakeOneWire{devices: []*fakeOneWireDevice{{}}}
+	o := newFakeOneWire(t, b)
+	o.openDrain = true
+	if err := o.Tx([]byte{0xCC, 0x44}, nil, onewire.StrongPullup); err == nil {
+		t.Fatal("expected error")
+	}
+	if b.resets != 0 {
+		t.Fatalf("resets=%d", b.resets)
+	}
+}
+
+func TestOneWire_Search(t *testing.T) {
+	a1 := fakeROM(0x28, 0x000001318252)
+	a2 := fakeROM(0x28, 0x000001318253)
+	a3 := fakeROM(0x10, 0x123456789ABC)
+	b := &fakeOneWire{devices: []*fakeOneWireDevice{{rom: a1}, {rom: a2}, {rom: a3}}}
+	o := newFakeOneWire(t, b)
+	addrs, err := o.Search(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []onewire.Address{a3, a1, a2}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("%#v != %#v", addrs, expected)
+	}
+}
+
+//
+
+// newFakeOneWire returns a OneWire connected to b.
+func newFakeOneWire(t *testing.T, b *fakeOneWire) *OneWire {
+	o, err := NewOneWire(&fakeOneWirePin{b: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.delay = b.advance
+	return o
+}
+
+// fakeROM returns a valid 1-wire address.
+func fakeROM(family byte, serial uint64) onewire.Address {
+	var b [8]byte
+	b[0] = family
+	for x := 1; x < 7; x++ {
+		b[x] = byte(serial >> uint(8*(x-1)))
+	}
+	b[7] = onewire.CalcCRC(b[:7])
+	var a onewire.Address
+	for x := 7; x >= 0; x-- {
+		a = a<<8 | onewire.Address(b[x])
+	}
+	return a
+}
+
+// fakeOneWire is a simulated 1-wire bus using a virtual time advanced by the
+// master's delays.
+type fakeOneWire struct {
+	devices []*fakeOneWireDevice
+	shorted bool
+	now     time.Duration
+	low     bool          // The master drives the line low.
+	lowAt   time.Duration // When the master started driving low.
+	strong  bool          // The master drives the line high.
+	resets  int
+}
+
+func (b *fakeOneWire) advance(d time.Duration) {
+	b.now += d
+}
+
+func (b *fakeOneWire) read() gpio.Level {
+	if b.shorted || b.low {
+		return gpio.Low
+	}
+	for _, d := range b.devices {
+		if d.lowFrom <= b.now && b.now < d.lowUntil {
+			return gpio.Low
+		}
+	}
+	return gpio.High
+}
+
+func (b *fakeOneWire) drive(l gpio.Level, strong bool) {
+	b.strong = strong
+	if !l {
+		if !b.low {
+			b.low = true
+			b.lowAt = b.now
+			for _, d := range b.devices {
+				d.onSlot(b.now)
+			}
+		}
+		return
+	}
+	if !b.low {
+		return
+	}
+	b.low = false
+	pulse := b.now - b.lowAt
+	if pulse >= owResetLow {
+		b.resets++
+	}
+	for _, d := range b.devices {
+		if pulse >= owResetLow {
+			d.onReset(b.now)
+		} else {
+			d.onRelease(pulse < 15*time.Microsecond)
+		}
+	}
+}
+
+// fakeOneWireDevice is a device that supports Search ROM, Skip ROM and
+// Read Scratchpad.
+type fakeOneWireDevice struct {
+	rom     onewire.Address
+	scratch []byte
+	rx      []byte // Function commands received.
+
+	state    int
+	in       byte
+	inBits   int
+	out      []bool        // Bits to send.
+	bit      int           // Search ROM bit index.
+	step     int           // Search ROM step: bit, complement, direction.
+	lowFrom  time.Duration // The device holds the line low in this window.
+	lowUntil time.Duration
+}
+
+const (
+	owIdle = iota
+	owROMCommand
+	owFunctionCommand
+	owSend
+	owSearch
+)
+
+func (d *fakeOneWireDevice) onReset(now time.Duration) {
+	// Presence pulse.
+	d.lowFrom, d.lowUntil = now+15*time.Microsecond, now+135*time.Microsecond
+	d.state = owROMCommand
+	d.in, d.inBits = 0, 0
+}
+
+// onSlot is called when the master starts a time slot.
+func (d *fakeOneWireDevice) onSlot(now time.Duration) {
+	hold := false
+	switch d.state {
+	case owSend:
+		hold = !d.out[0]
+		if d.out = d.out[1:]; len(d.out) == 0 {
+			d.state = owIdle
+		}
+	case owSearch:
+		v := d.rom>>uint(d.bit)&1 == 1
+		switch d.step {
+		case 0:
+			hold = !v
+		case 1:
+			hold = v
+		}
+	}
+	if hold {
+		d.lowFrom, d.lowUntil = now, now+30*time.Microsecond
+	}
+}
+
+// onRelease is called when the master ends a time slot.
+func (d *fakeOneWireDevice) onRelease(bit bool) {
+	switch d.state {
+	case owROMCommand, owFunctionCommand:
+		if bit {
+			d.in |= 1 << uint(d.inBits)
+		}
+		if d.inBits++; d.inBits == 8 {
+			d.onByte(d.in)
+			d.in, d.inBits = 0, 0
+		}
+	case owSearch:
+		if d.step != 2 {
+			d.step++
+			return
+		}
+		if bit != (d.rom>>uint(d.bit)&1 == 1) {
+			d.state = owIdle
+			return
+		}
+		d.step = 0
+		if d.bit++; d.bit == 64 {
+			d.state = owIdle
+		}
+	}
+}
+
+func (d *fakeOneWireDevice) onByte(b byte) {
+	if d.state == owROMCommand {
+		switch b {
+		case 0xCC:
+			d.state = owFunctionCommand
+		case 0xF0:
+			d.state = owSearch
+			d.bit, d.step = 0, 0
+		default:
+			d.state = owIdle
+		}
+		return
+	}
+	d.rx = append(d.rx, b)
+	if b == 0xBE {
+		d.out = nil
+		for _, v := range d.scratch {
+			for x := uint(0); x < 8; x++ {
+				d.out = append(d.out, v&(1<<x) != 0)
+			}
+		}
+		d.state = owSend
+	}
+}
+
+// fakeOneWirePin is the data line of a fakeOneWire.
+type fakeOneWirePin struct {
+	b *fakeOneWire
+	// outErr is returned by Out once it was called failAfter times.
+	outErr    error
+	outs      int
+	failAfter int
+}
+
+func (p *fakeOneWirePin) String() string {
+	return p.Name()
+}
+
+func (p *fakeOneWirePin) Halt() error {
+	return nil
+}
+
+func (p *fakeOneWirePin) Name() string {
+	return "Q"
+}
+
+func (p *fakeOneWirePin) Number() int {
+	return -1
+}
+
+func (p *fakeOneWirePin) Function() string {
+	return ""
+}
+
+func (p *fakeOneWirePin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.b.drive(gpio.High, false)
+	return nil
+}
+
+func (p *fakeOneWirePin) Read() gpio.Level {
+	return p.b.read()
+}
+
+func (p *fakeOneWirePin) WaitForEdge(timeout time.Duration) bool {
+	return false
+}
+
+func (p *fakeOneWirePin) Pull() gpio.Pull {
+	return gpio.PullUp
+}
+
+func (p *fakeOneWirePin) DefaultPull() gpio.Pull {
+	return gpio.PullUp
+}
+
+func (p *fakeOneWirePin) Out(l gpio.Level) error {
+	if p.outs++; p.outErr != nil && p.outs > p.failAfter {
+		return p.outErr
+	}
+	p.b.drive(l, bool(l))
+	return nil
+}
+
+func (p *fakeOneWirePin) PWM(duty gpio.Duty, f physic.Frequency) error {
+	return nil
+}
+
+var _ gpio.PinIO = &fakeOneWirePin{}
@@ -0,0 +1,385 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"periph.io/x/periph/conn/physic"
+)
+
+// NewPlayback returns a bit-banged I²C bus over two simulated pins, connected
+// to a simulated device that replays ops.
+//
+// Unlike i2ctest.Playback, each transaction goes through the bit-banged
+// protocol, so it can be used to test device drivers against this bus without
+// hardware. The bus is not shared like the ones returned by New.
+func NewPlayback(ops []i2ctest.IO) *Playback {
+	p := &Playback{
+		Ops:  ops,
+		sclM: gpio.High,
+		sdaM: gpio.High,
+		sdaS: gpio.High,
+		scl:  gpio.High,
+		sda:  gpio.High,
+	}
+	// It can't fail.
+	p.I2C, _ = newI2C(&playbackPin{p: p, clk: true}, &playbackPin{p: p}, MaxSpeed)
+	p.Edges = nil
+	return p
+}
+
+// Playback is a bit-banged I²C bus connected to a simulated device.
+//
+// The simulated device acknowledges the address and the bytes written as long
+// as they match the next operation in Ops, and returns its R bytes when
+// addressed for a read.
+type Playback struct {
+	*I2C
+
+	mu    sync.Mutex
+	Ops   []i2ctest.IO
+	Count int
+	// Edges records the line transitions, as "C0", "C1", "D0" or "D1".
+	Edges []string
+
+	err        error      // First mismatch.
+	sclM, sdaM gpio.Level // Master drive; High means released.
+	sdaS       gpio.Level // Device drive; High means released.
+	scl, sda   gpio.Level // Effective level.
+	op         *i2ctest.IO
+	w          []byte // Bytes written in the current operation.
+	rIndex     int    // Bytes read in the current operation.
+	addressing bool   // Waiting for an address byte.
+	addrHigh   uint16 // Upper bits of a 10-bit address; 0 if not started.
+	tenBits    bool   // The device was addressed with a 10-bit address.
+	reading    bool   // The device is transmitting.
+	nacked     bool   // The master NACK'ed the last byte read.
+	ackSlot    bool
+	bit        int
+	cur        byte
+	capture    *Capture // Records the transactions instead of verifying them.
+	resp       []byte   // Bytes sent in capture mode.
+}
+
+// Close closes the bus and verifies that all the expected Ops have been
+// consumed and that no transaction mismatched.
+func (p *Playback) Close() error {
+	// The pins lock p.mu, so the bus must be closed first.
+	err := p.I2C.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if len(p.Ops) != p.Count {
+		return fmt.Errorf("bitbang-playback: expected playback to be empty: I/O count %d; expected %d", p.Count, len(p.Ops))
+	}
+	return nil
+}
+
+//
+
+// drive is called with the lock held when the master changes a line.
+func (p *Playback) drive(clk bool, l gpio.Level) {
+	if clk {
+		p.sclM = l
+	} else {
+		p.sdaM = l
+	}
+	for {
+		if scl := p.sclM; scl != p.scl {
+			p.scl = scl
+			p.Edges = append(p.Edges, "C"+playbackLevel(scl))
+			if scl {
+				p.onRise()
+			} else {
+				p.onFall()
+			}
+			continue
+		}
+		if sda := p.sdaM && p.sdaS; sda != p.sda {
+			p.sda = sda
+			p.Edges = append(p.Edges, "D"+playbackLevel(sda))
+			if p.scl {
+				if sda {
+					p.onStop()
+				} else {
+					p.onStart()
+				}
+			}
+			continue
+		}
+		return
+	}
+}
+
+// onStart handles a START or a repeated START condition.
+func (p *Playback) onStart() {
+	if p.op == nil {
+		if p.capture != nil {
+			p.Ops = append(p.Ops, i2ctest.IO{})
+		} else if p.Count >= len(p.Ops) {
+			p.fail("unexpected transaction (count #%d)", p.Count)
+			return
+		}
+		p.op = &p.Ops[p.Count]
+		p.w = nil
+		p.rIndex = 0
+		p.tenBits = false
+	}
+	p.addressing = true
+	p.addrHigh = 0
+	p.reading = false
+	p.nacked = false
+	p.ackSlot = false
+	p.bit = 0
+	p.cur = 0
+	p.sdaS = gpio.High
+}
+
+// onStop handles a STOP condition, which completes the operation.
+func (p *Playback) onStop() {
+	if p.op == nil {
+		return
+	}
+	if p.capture != nil {
+		p.op.W = p.w
+	} else if !bytes.Equal(p.w, p.op.W) {
+		p.fail("unexpected write (count #%d) %#v != %#v", p.Count, p.w, p.op.W)
+	} else if p.rIndex != len(p.op.R) {
+		p.fail("unexpected read length (count #%d) %d != %d", p.Count, p.rIndex, len(p.op.R))
+	}
+	p.op = nil
+	p.sdaS = gpio.High
+	p.Count++
+}
+
+// onRise samples SDA.
+func (p *Playback) onRise() {
+	if p.op == nil {
+		return
+	}
+	if p.ackSlot {
+		if p.reading {
+			p.nacked = bool(p.sda)
+		}
+		return
+	}
+	if !p.reading {
+		p.cur <<= 1
+		if p.sda {
+			p.cur |= 1
+		}
+	}
+	p.bit++
+}
+
+// onFall drives SDA.
+func (p *Playback) onFall() {
+	if p.op == nil {
+		return
+	}
+	if p.ackSlot {
+		p.ackSlot = false
+		p.bit = 0
+		p.sdaS = gpio.High
+		if p.reading && !p.nacked {
+			p.driveBit()
+		}
+		return
+	}
+	if p.bit == 8 {
+		p.ackSlot = true
+		if p.reading {
+			// Let the master ACK.
+			p.sdaS = gpio.High
+			if p.capture != nil {
+				p.op.R = append(p.op.R, p.readAt(p.rIndex))
+			}
+			p.rIndex++
+			return
+		}
+		if p.receive(p.cur) {
+			p.sdaS = gpio.Low
+		}
+		p.cur = 0
+		return
+	}
+	if p.reading {
+		p.driveBit()
+	}
+}
+
+// receive handles a byte written by the master and returns true to ACK it.
+func (p *Playback) receive(b byte) bool {
+	if !p.addressing {
+		if p.capture != nil {
+			p.w = append(p.w, b)
+			return true
+		}
+		if len(p.w) >= len(p.op.W) || p.op.W[len(p.w)] != b {
+			p.fail("unexpected write (count #%d) %#v != %#v", p.Count, append(p.w, b), p.op.W)
+			return false
+		}
+		p.w = append(p.w, b)
+		return true
+	}
+	if p.addrHigh != 0 {
+		// Second byte of a 10-bit address.
+		p.tenBits = true
+		return p.address(p.addrHigh&0x3FF|uint16(b), false)
+	}
+	if b&0xF8 == 0xF0 {
+		// Page 15, section 3.1.11 10-bit addressing
+		hi := uint16(b&0x06) << 7
+		if b&1 == 0 {
+			p.addrHigh = 0x400 | hi
+			return true
+		}
+		// A read is only valid once the device was addressed for writing.
+		if !p.tenBits {
+			p.fail("unexpected 10-bit read (count #%d) without the device being addressed first", p.Count)
+			return false
+		}
+		return p.address(hi|p.op.Addr&0xFF, true)
+	}
+	return p.address(uint16(b>>1), b&1 == 1)
+}
+
+// address handles the device being addressed.
+func (p *Playback) address(addr uint16, read bool) bool {
+	if p.capture != nil {
+		p.op.Addr = addr
+		p.addressing = false
+		p.addrHigh = 0
+		p.reading = read
+		if read {
+			p.resp = nil
+			if p.capture.Responder != nil {
+				p.resp = p.capture.Responder(addr, p.w)
+			}
+		}
+		return true
+	}
+	if addr != p.op.Addr {
+		p.fail("unexpected addr (count #%d) %#x != %#x", p.Count, addr, p.op.Addr)
+		return false
+	}
+	p.addressing = false
+	p.addrHigh = 0
+	p.reading = read && p.rIndex < len(p.op.R)
+	return true
+}
+
+// driveBit drives the next bit to send on SDA.
+func (p *Playback) driveBit() {
+	if p.capture == nil && p.rIndex >= len(p.op.R) {
+		p.fail("unexpected read (count #%d) past %d bytes", p.Count, len(p.op.R))
+		p.reading = false
+		return
+	}
+	p.sdaS = gpio.Level(p.readAt(p.rIndex)&(0x80>>uint(p.bit)) != 0)
+}
+
+// readAt returns the byte at index i to send.
+func (p *Playback) readAt(i int) byte {
+	if p.capture == nil {
+		return p.op.R[i]
+	}
+	if i < len(p.resp) {
+		return p.resp[i]
+	}
+	return 0
+}
+
+// fail records the first mismatch.
+func (p *Playback) fail(format string, a ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("bitbang-playback: "+format, a...)
+	}
+}
+
+func playbackLevel(l gpio.Level) string {
+	if l {
+		return "1"
+	}
+	return "0"
+}
+
+// playbackPin is one of the two simulated lines of a Playback.
+type playbackPin struct {
+	p   *Playback
+	clk bool
+}
+
+func (p *playbackPin) String() string {
+	return p.Name()
+}
+
+func (p *playbackPin) Halt() error {
+	return nil
+}
+
+func (p *playbackPin) Name() string {
+	if p.clk {
+		return "SCL"
+	}
+	return "SDA"
+}
+
+func (p *playbackPin) Number() int {
+	return -1
+}
+
+func (p *playbackPin) Function() string {
+	return ""
+}
+
+func (p *playbackPin) In(pull gpio.Pull, edge gpio.Edge) error {
+	return p.Out(gpio.High)
+}
+
+func (p *playbackPin) Read() gpio.Level {
+	p.p.mu.Lock()
+	defer p.p.mu.Unlock()
+	if p.clk {
+		return p.p.scl
+	}
+	return p.p.sda
+}
+
+func (p *playbackPin) WaitForEdge(timeout time.Duration) bool {
+	return false
+}
+
+func (p *playbackPin) Pull() gpio.Pull {
+	return gpio.PullUp
+}
+
+func (p *playbackPin) DefaultPull() gpio.Pull {
+	return gpio.PullUp
+}
+
+func (p *playbackPin) Out(l gpio.Level) error {
+	p.p.mu.Lock()
+	defer p.p.mu.Unlock()
+	p.p.drive(p.clk, l)
+	return nil
+}
+
+func (p *playbackPin) PWM(duty gpio.Duty, f physic.Frequency) error {
+	return fmt.Errorf("bitbang-playback: can't PWM %s", p)
+}
+
+var _ gpio.PinIO = &playbackPin{}
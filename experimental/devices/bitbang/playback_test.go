@@ -0,0 +1,93 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"reflect"
+	"testing"
+
+	"periph.io/x/periph/conn/i2c/i2ctest"
+)
+
+func TestPlayback(t *testing.T) {
+	p := NewPlayback([]i2ctest.IO{
+		{Addr: 0x10, W: []byte{0x01, 0x02}},
+		{Addr: 0x10, W: []byte{0x03}, R: []byte{0xA5, 0x5A}},
+	})
+	if err := p.TxSequence(0x10, []Op{{Buf: []byte{0x01, 0x02}}}); err != nil {
+		t.Fatal(err)
+	}
+	r := make([]byte, 2)
+	if err := p.TxRepeatedStart(0x10, []byte{0x03}, r); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0xA5, 0x5A}; !reflect.DeepEqual(r, expected) {
+		t.Fatalf("%#v != %#v", r, expected)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Edges) == 0 {
+		t.Fatal("expected edges")
+	}
+}
+
+func TestPlayback_10bits(t *testing.T) {
+	p := NewPlayback([]i2ctest.IO{{Addr: 0x3C0, W: []byte{0x01}, R: []byte{0x42}}})
+	r := make([]byte, 1)
+	if err := p.Tx(0x3C0, []byte{0x01}, r); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != 0x42 {
+		t.Fatalf("%#x", r[0])
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlayback_Mismatch(t *testing.T) {
+	p := NewPlayback([]i2ctest.IO{{Addr: 0x10, W: []byte{0x01}}})
+	err := p.TxSequence(0x10, []Op{{Buf: []byte{0x02}}})
+	if e, ok := err.(*NACKError); !ok || e.Phase != "write" {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	p = NewPlayback([]i2ctest.IO{{Addr: 0x10, W: []byte{0x01}}})
+	err = p.TxSequence(0x11, []Op{{Buf: []byte{0x01}}})
+	if e, ok := err.(*NACKError); !ok || e.Phase != "address" {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPlayback_NotConsumed(t *testing.T) {
+	p := NewPlayback([]i2ctest.IO{{Addr: 0x10, W: []byte{0x01}}})
+	if err := p.Close(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPlayback_Close(t *testing.T) {
+	p := NewPlayback(nil)
+	// The bus is not shared, so it doesn't need to be closed.
+	busesMu.Lock()
+	_, ok := buses[busKey{p.I2C.scl, p.I2C.sda}]
+	busesMu.Unlock()
+	if ok {
+		t.Fatal("expected the bus to not be registered")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Tx(0x10, []byte{0x01}, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
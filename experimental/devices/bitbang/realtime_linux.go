@@ -0,0 +1,26 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import "syscall"
+
+// raisePriority sets the highest nice value on the current OS thread and
+// returns a function to restore the previous one.
+//
+// The thread must be locked with runtime.LockOSThread.
+func raisePriority() (func(), error) {
+	tid := syscall.Gettid()
+	// The raw syscall returns 20-nice.
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, -20); err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Setpriority(syscall.PRIO_PROCESS, tid, 20-prio)
+	}, nil
+}
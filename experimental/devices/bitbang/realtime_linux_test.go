@@ -0,0 +1,33 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSetRealtime(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	i := newFakeI2C(t, b)
+	i.SetRealtime(true)
+	prio := 0
+	i.SetLogger(func(format string, args ...interface{}) {
+		if strings.HasSuffix(format, "START") {
+			prio, _ = syscall.Getpriority(syscall.PRIO_PROCESS, syscall.Gettid())
+		}
+	})
+	if err := i.Tx(0x10, []byte{0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 && prio != 40 {
+		t.Fatalf("expected nice -20, got %d", 20-prio)
+	}
+	if i.restorePriority != nil {
+		t.Fatal("expected the priority to be restored")
+	}
+}
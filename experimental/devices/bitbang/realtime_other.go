@@ -0,0 +1,12 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// +build !linux
+
+package bitbang
+
+// raisePriority is not supported on this platform.
+func raisePriority() (func(), error) {
+	return nil, nil
+}
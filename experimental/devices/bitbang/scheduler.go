@@ -0,0 +1,118 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/physic"
+)
+
+// NewScheduler returns a Scheduler that runs the transactions on i from a
+// single goroutine locked to its OS thread.
+//
+// Close must be called to stop the goroutine.
+func NewScheduler(i *I2C) *Scheduler {
+	s := &Scheduler{
+		i:    i,
+		reqs: make(chan *schedulerReq),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Scheduler serializes the transactions submitted from multiple goroutines.
+//
+// All the bit-banging happens on the same OS thread, which avoids locking and
+// unlocking the thread on each transaction and migrating between threads.
+//
+// It implements i2c.Bus, so it can be passed to device drivers.
+type Scheduler struct {
+	i    *I2C
+	reqs chan *schedulerReq
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *Scheduler) String() string {
+	return fmt.Sprintf("bitbang/scheduler(%s)", s.i)
+}
+
+// Go submits a transaction and returns right away.
+//
+// The channel returned receives the result of the transaction once it is
+// done; w and r must not be used until then. It receives ErrClosed if the
+// Scheduler was closed.
+func (s *Scheduler) Go(addr uint16, w, r []byte) <-chan error {
+	c := make(chan error, 1)
+	select {
+	case s.reqs <- &schedulerReq{addr: addr, w: w, r: r, result: c}:
+	case <-s.stop:
+		c <- ErrClosed
+	}
+	return c
+}
+
+// Tx implements i2c.Bus.
+//
+// It submits the transaction and waits for its result.
+func (s *Scheduler) Tx(addr uint16, w, r []byte) error {
+	return <-s.Go(addr, w, r)
+}
+
+// SetSpeed implements i2c.Bus.
+func (s *Scheduler) SetSpeed(f physic.Frequency) error {
+	return s.i.SetSpeed(f)
+}
+
+// Close stops the goroutine once the transaction in progress, if any, is
+// done.
+//
+// It doesn't close the underlying bus. Calling Close more than once is a
+// no-op.
+func (s *Scheduler) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+//
+
+// schedulerReq is a transaction submitted to a Scheduler.
+type schedulerReq struct {
+	addr   uint16
+	w, r   []byte
+	result chan<- error
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case q := <-s.reqs:
+			q.result <- s.do(q)
+		}
+	}
+}
+
+// do runs a transaction on the thread owned by run.
+func (s *Scheduler) do(q *schedulerReq) error {
+	s.i.mu.Lock()
+	defer s.i.mu.Unlock()
+	return s.i.tx(context.Background(), q.addr, q.w, q.r, false)
+}
+
+var _ i2c.Bus = &Scheduler{}
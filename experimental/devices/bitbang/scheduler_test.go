@@ -0,0 +1,90 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"periph.io/x/periph/conn/i2c/i2ctest"
+)
+
+func TestScheduler(t *testing.T) {
+	bus, c := NewCapture()
+	c.Responder = func(addr uint16, w []byte) []byte {
+		return []byte{byte(addr)}
+	}
+	s := NewScheduler(bus)
+	defer s.Close()
+	const n = 5
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	reads := make([][]byte, n)
+	for x := 0; x < n; x++ {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			reads[x] = make([]byte, 1)
+			errs[x] = s.Tx(uint16(0x10+x), []byte{byte(x)}, reads[x])
+		}(x)
+	}
+	wg.Wait()
+	for x := 0; x < n; x++ {
+		if errs[x] != nil {
+			t.Fatal(errs[x])
+		}
+		if reads[x][0] != byte(0x10+x) {
+			t.Fatalf("#%d: %#x", x, reads[x][0])
+		}
+	}
+	// Each transaction was recorded whole, in any order.
+	ops := c.Ops()
+	if len(ops) != n {
+		t.Fatalf("%#v", ops)
+	}
+	sort.Sort(byAddr(ops))
+	for x, op := range ops {
+		if op.Addr != uint16(0x10+x) || !reflect.DeepEqual(op.W, []byte{byte(x)}) || !reflect.DeepEqual(op.R, []byte{byte(0x10 + x)}) {
+			t.Fatalf("#%d: %#v", x, op)
+		}
+	}
+}
+
+func TestScheduler_Go(t *testing.T) {
+	bus, c := NewCapture()
+	s := NewScheduler(bus)
+	first := s.Go(0x10, []byte{0x01}, nil)
+	second := s.Go(0x10, []byte{0x02}, nil)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	// Transactions submitted from the same goroutine run in order.
+	if ops := c.Ops(); len(ops) != 2 || ops[0].W[0] != 0x01 || ops[1].W[0] != 0x02 {
+		t.Fatalf("%#v", ops)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Tx(0x10, []byte{0x03}, nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+//
+
+// byAddr sorts the transactions by address.
+type byAddr []i2ctest.IO
+
+func (b byAddr) Len() int           { return len(b) }
+func (b byAddr) Less(i, j int) bool { return b[i].Addr < b[j].Addr }
+func (b byAddr) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,153 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Specification
+//
+// http://smbus.org/specs/SMBus_3_1_20180319.pdf
+
+package bitbang
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// MaxBlockSize is the maximum number of bytes in a SMBus block transfer.
+const MaxBlockSize = 32
+
+// ErrPEC is returned when the Packet Error Code of a SMBus block read doesn't
+// match.
+var ErrPEC = errors.New("bitbang-smbus: invalid PEC")
+
+// SMBus implements SMBus block transfers on top of a bit-banged I²C bus.
+type SMBus struct {
+	i *I2C
+	// PEC enables the Packet Error Code, a CRC-8 appended to each transfer.
+	PEC bool
+}
+
+// NewSMBus returns a SMBus using the bit-banged I²C bus i.
+func NewSMBus(i *I2C) *SMBus {
+	return &SMBus{i: i}
+}
+
+func (s *SMBus) String() string {
+	return fmt.Sprintf("bitbang/smbus(%s)", s.i)
+}
+
+// WriteBlock does a Block Write: the command byte, the byte count then data.
+//
+// Section 6.5.7 Block write/read
+func (s *SMBus) WriteBlock(addr uint16, cmd byte, data []byte) error {
+	if err := checkSMBusAddr(addr); err != nil {
+		return err
+	}
+	if len(data) > MaxBlockSize {
+		return fmt.Errorf("bitbang-smbus: block of %d bytes is above %d", len(data), MaxBlockSize)
+	}
+	w := make([]byte, 0, len(data)+3)
+	w = append(w, cmd, byte(len(data)))
+	w = append(w, data...)
+	if s.PEC {
+		w = append(w, crc8(crc8(0, byte(addr<<1)), w...))
+	}
+	return s.i.TxSequence(addr, []Op{{Buf: w}})
+}
+
+// ReadBlock does a Block Read: it writes the command byte then reads the
+// byte count and data after a repeated START.
+//
+// Section 6.5.7 Block write/read
+func (s *SMBus) ReadBlock(addr uint16, cmd byte) ([]byte, error) {
+	if err := checkSMBusAddr(addr); err != nil {
+		return nil, err
+	}
+	s.i.mu.Lock()
+	defer s.i.mu.Unlock()
+	if err := s.i.checkAddr(addr); err != nil {
+		return nil, err
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return s.readBlock(addr, cmd)
+}
+
+// readBlock does a Block Read while the bus lock is held.
+func (s *SMBus) readBlock(addr uint16, cmd byte) (data []byte, err error) {
+	i := s.i
+	if err := i.begin(context.Background()); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := i.end(err); err == nil {
+			err = err2
+		}
+	}()
+	if err := i.writeAddr(addr, false, "address"); err != nil {
+		return nil, err
+	}
+	if err := i.writeAcked(cmd, "write", 0); err != nil {
+		return nil, err
+	}
+	if err := i.restart(); err != nil {
+		return nil, err
+	}
+	if err := i.writeAddr(addr, true, "read-restart"); err != nil {
+		return nil, err
+	}
+	count, err := i.readBits()
+	if err != nil {
+		return nil, err
+	}
+	n := int(count)
+	if s.PEC {
+		n++
+	}
+	// NACK the count if no byte follows, or if the block is not read.
+	if err := i.sendACK(count, n != 0 && count <= MaxBlockSize); err != nil {
+		return nil, err
+	}
+	if count > MaxBlockSize {
+		return nil, fmt.Errorf("bitbang-smbus: block of %d bytes is above %d", count, MaxBlockSize)
+	}
+	buf := make([]byte, n)
+	if err := i.readBytes(buf, true); err != nil {
+		return nil, err
+	}
+	if s.PEC {
+		c := crc8(0, byte(addr<<1), cmd, byte(addr<<1|1), count)
+		if crc8(c, buf[:n-1]...) != buf[n-1] {
+			return nil, ErrPEC
+		}
+		buf = buf[:n-1]
+	}
+	return buf, nil
+}
+
+// checkSMBusAddr returns an error if addr is not a 7-bit address.
+func checkSMBusAddr(addr uint16) error {
+	if addr > 0x7F {
+		return errors.New("bitbang-smbus: invalid address")
+	}
+	return nil
+}
+
+// crc8 updates the CRC-8 c used for the PEC with b.
+//
+// Section 6.4 Packet Error Checking: the polynomial is x^8 + x^2 + x + 1.
+func crc8(c byte, b ...byte) byte {
+	for _, d := range b {
+		c ^= d
+		for x := 0; x < 8; x++ {
+			if c&0x80 != 0 {
+				c = c<<1 ^ 0x07
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return c
+}
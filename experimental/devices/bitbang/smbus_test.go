@@ -0,0 +1,142 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSMBus_ReadBlock(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{4, 0x01, 0x02, 0x03, 0x04}}}
+	s := NewSMBus(newFakeI2C(t, b))
+	data, err := s.ReadBlock(0x10, 0x20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x01, 0x02, 0x03, 0x04}; !reflect.DeepEqual(data, expected) {
+		t.Fatalf("%#v != %#v", data, expected)
+	}
+	expected := [][]byte{{0x20, 0x20}, {0x21}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+	if b.slave.starts != 2 || b.slave.stops != 1 {
+		t.Fatalf("starts=%d stops=%d", b.slave.starts, b.slave.stops)
+	}
+}
+
+func TestSMBus_ReadBlock_Empty(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{0}}}
+	s := NewSMBus(newFakeI2C(t, b))
+	data, err := s.ReadBlock(0x10, 0x20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("%#v", data)
+	}
+	// The count byte is the last one read.
+	if expected := []bool{false}; !reflect.DeepEqual(b.slave.acks, expected) {
+		t.Fatalf("%#v != %#v", b.slave.acks, expected)
+	}
+	if b.slave.stops != 1 {
+		t.Fatalf("stops=%d", b.slave.stops)
+	}
+}
+
+func TestSMBus_ReadBlock_PEC(t *testing.T) {
+	tx := []byte{4, 0x01, 0x02, 0x03, 0x04}
+	pec := crc8(crc8(0, 0x20, 0x20, 0x21), tx...)
+	b := &fakeWire{slave: &fakeSlave{tx: append(tx, pec)}}
+	s := NewSMBus(newFakeI2C(t, b))
+	s.PEC = true
+	data, err := s.ReadBlock(0x10, 0x20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x01, 0x02, 0x03, 0x04}; !reflect.DeepEqual(data, expected) {
+		t.Fatalf("%#v != %#v", data, expected)
+	}
+
+	b = &fakeWire{slave: &fakeSlave{tx: append(tx, pec+1)}}
+	s = NewSMBus(newFakeI2C(t, b))
+	s.PEC = true
+	if _, err := s.ReadBlock(0x10, 0x20); err != ErrPEC {
+		t.Fatal(err)
+	}
+}
+
+func TestSMBus_ReadBlock_TooLong(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{MaxBlockSize + 1}}}
+	s := NewSMBus(newFakeI2C(t, b))
+	if _, err := s.ReadBlock(0x10, 0x20); err == nil {
+		t.Fatal("expected error")
+	}
+	if expected := []bool{false}; !reflect.DeepEqual(b.slave.acks, expected) {
+		t.Fatalf("%#v != %#v", b.slave.acks, expected)
+	}
+	if b.slave.stops != 1 {
+		t.Fatalf("stops=%d", b.slave.stops)
+	}
+}
+
+func TestSMBus_WriteBlock(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{}}
+	s := NewSMBus(newFakeI2C(t, b))
+	s.PEC = true
+	if err := s.WriteBlock(0x10, 0x20, []byte{0x01, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	pec := crc8(0, 0x20, 0x20, 0x02, 0x01, 0x02)
+	expected := [][]byte{{0x20, 0x20, 0x02, 0x01, 0x02, pec}}
+	if !reflect.DeepEqual(b.slave.frames, expected) {
+		t.Fatalf("%#v != %#v", b.slave.frames, expected)
+	}
+}
+
+func TestSMBus_InvalidAddr(t *testing.T) {
+	s := NewSMBus(newFakeI2C(t, &fakeWire{}))
+	if _, err := s.ReadBlock(0x3C0, 0x20); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := s.WriteBlock(0x3C0, 0x20, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := s.WriteBlock(0x10, 0x20, make([]byte, MaxBlockSize+1)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSMBus_ReservedAddr(t *testing.T) {
+	b := &fakeWire{slave: &fakeSlave{tx: []byte{1, 0x01}}}
+	i := newFakeI2C(t, b)
+	s := NewSMBus(i)
+	b.reset()
+	if _, err := s.ReadBlock(0x78, 0x20); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := s.WriteBlock(0x78, 0x20, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(b.trace) != 0 {
+		t.Fatal(b.trace)
+	}
+	i.SetAllowReservedAddresses(true)
+	data, err := s.ReadBlock(0x78, 0x20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x01}; !reflect.DeepEqual(data, expected) {
+		t.Fatalf("%#v != %#v", data, expected)
+	}
+}
+
+func TestCRC8(t *testing.T) {
+	// Standard CRC-8 check value.
+	if c := crc8(0, []byte("123456789")...); c != 0xF4 {
+		t.Fatalf("%#x", c)
+	}
+}
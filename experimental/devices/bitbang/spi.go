@@ -26,7 +26,8 @@ import (
 
 // NewSPI returns an spi.PortCloser that communicates SPI over 3 or 4 pins.
 //
-// BUG(maruel): Completely untested.
+// The clock polarity and phase (modes 0 to 3) and the bit order are
+// specified to Connect.
 //
 // cs can be nil.
 func NewSPI(clk, mosi gpio.PinOut, miso gpio.PinIn, cs gpio.PinOut) (*SPI, error) {
@@ -63,9 +64,6 @@ func (s *SPI) Connect(f physic.Frequency, mode spi.Mode, bits int) (spi.Conn, er
 	if mode&spi.HalfDuplex == spi.HalfDuplex {
 		return nil, errors.New("bitbang-spi: half-duplex mode not supported")
 	}
-	if mode&spi.LSBFirst == spi.LSBFirst {
-		return nil, errors.New("bitbang-spi: LSBFirst mode not supported")
-	}
 	if mode >= 0x20 {
 		return nil, fmt.Errorf("bitbang-spi: unhandled mode %d(%s)", mode, mode.String())
 	}
@@ -159,9 +157,11 @@ func (s *spiConn) Duplex() conn.Duplex {
 
 // Tx implements spi.Conn.
 //
-// BUG(maruel): Implement mode (HalfDuplex and LSBFirst remain to be done).
+// Bits are shifted most significant bit first, unless spi.LSBFirst was
+// specified.
+//
+// BUG(maruel): Implement HalfDuplex.
 // BUG(maruel): Implement bits.
-// BUG(maruel): Test if read works.
 func (s *spiConn) Tx(w, r []byte) (err error) {
 	if len(r) != 0 && len(w) != len(r) {
 		return errors.New("bitbang-spi: write and read buffers must be the same length")
@@ -175,28 +175,41 @@ func (s *spiConn) Tx(w, r []byte) (err error) {
 	}
 
 	for i := uint(0); i < uint(len(w)*8); i++ {
-		if err = s.sdo.Out(w[i/8]&(1<<(i%8)) != 0); err != nil {
-			return fmt.Errorf("bitbang-spi: failed to send bit %d of word %d: %v", i%8, i/8, err)
+		mask := byte(0x80) >> (i % 8)
+		if s.mode&spi.LSBFirst == spi.LSBFirst {
+			mask = 1 << (i % 8)
 		}
-
-		s.sleepHalfCycle()
-		if err = s.sck.Out(!s.clockIdle); err != nil {
-			return fmt.Errorf("bitbang-spi: failed to assert clock: %v", err)
+		if s.readAfterClockPulse {
+			// CPHA=1: data is shifted out on the leading edge and sampled on the
+			// trailing edge.
+			if err = s.sck.Out(!s.clockIdle); err != nil {
+				return fmt.Errorf("bitbang-spi: failed to assert clock: %v", err)
+			}
+		}
+		if err = s.sdo.Out(w[i/8]&mask != 0); err != nil {
+			return fmt.Errorf("bitbang-spi: failed to send bit %d of word %d: %v", i%8, i/8, err)
 		}
 		s.sleepHalfCycle()
-
 		if s.readAfterClockPulse {
 			if err = s.sck.Out(s.clockIdle); err != nil {
 				return fmt.Errorf("bitbang-spi: failed to idle clock: %v", err)
 			}
-			s.sleepHalfCycle()
+		} else {
+			// CPHA=0: data is sampled on the leading edge and shifted out on the
+			// trailing edge.
+			if err = s.sck.Out(!s.clockIdle); err != nil {
+				return fmt.Errorf("bitbang-spi: failed to assert clock: %v", err)
+			}
 		}
 
 		if len(r) != 0 {
 			if s.sdi.Read() == gpio.High {
-				r[i/8] |= 1 << (i % 8)
+				r[i/8] |= mask
+			} else {
+				r[i/8] &^= mask
 			}
 		}
+		s.sleepHalfCycle()
 
 		if !s.readAfterClockPulse {
 			if err = s.sck.Out(s.clockIdle); err != nil {
@@ -0,0 +1,202 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package bitbang
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/conn/spi"
+)
+
+func TestSPI_Mode0(t *testing.T) {
+	testSPIEcho(t, spi.Mode0)
+}
+
+func TestSPI_Mode3(t *testing.T) {
+	testSPIEcho(t, spi.Mode3)
+}
+
+func TestSPI_LSBFirst(t *testing.T) {
+	testSPIEcho(t, spi.Mode1|spi.LSBFirst)
+}
+
+func TestSPI_Connect_Invalid(t *testing.T) {
+	s, _ := newFakeSPI(&fakeSPISlave{})
+	if _, err := s.Connect(-1, spi.Mode0, 8); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := s.Connect(physic.MegaHertz, spi.HalfDuplex, 8); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func testSPIEcho(t *testing.T, mode spi.Mode) {
+	d := &fakeSPISlave{mode: mode}
+	s, _ := newFakeSPI(d)
+	c, err := s.Connect(physic.MegaHertz, mode, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.clk != gpio.Level(mode&spi.Mode2 == spi.Mode2) {
+		t.Fatal("clock is not idle")
+	}
+	w := []byte{0xA1, 0x3C, 0x0F}
+	r := make([]byte, len(w))
+	if err := c.Tx(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.rx, w) {
+		t.Fatalf("%#v != %#v", d.rx, w)
+	}
+	// The slave echoes the previous byte.
+	if expected := []byte{0x00, 0xA1, 0x3C}; !reflect.DeepEqual(r, expected) {
+		t.Fatalf("%#v != %#v", r, expected)
+	}
+	if d.selected {
+		t.Fatal("CS is still asserted")
+	}
+	if d.clk != gpio.Level(mode&spi.Mode2 == spi.Mode2) {
+		t.Fatal("clock is not idle")
+	}
+}
+
+//
+
+// newFakeSPI returns a SPI port connected to d.
+func newFakeSPI(d *fakeSPISlave) (*SPI, error) {
+	return NewSPI(&fakeSPIPin{d: d, name: "CLK"}, &fakeSPIPin{d: d, name: "MOSI"}, &fakeSPIPin{d: d, name: "MISO"}, &fakeSPIPin{d: d, name: "CS"})
+}
+
+// fakeSPISlave is a SPI slave that echoes back the previous byte received.
+type fakeSPISlave struct {
+	mode     spi.Mode
+	clk      gpio.Level
+	mosi     gpio.Level
+	miso     gpio.Level
+	selected bool
+	bit      int  // Bits sampled in cur.
+	cur      byte // Byte being received.
+	out      byte // Byte being sent.
+	outBit   int  // Bits sent from out.
+	rx       []byte
+}
+
+// onCS is called when CS changes.
+func (s *fakeSPISlave) onCS(l gpio.Level) {
+	s.selected = l == gpio.Low
+	if s.selected {
+		s.bit, s.cur, s.out, s.outBit = 0, 0, 0, 0
+		if s.mode&spi.Mode1 == 0 {
+			s.drive()
+		}
+	}
+}
+
+// onCLK is called when the clock changes.
+func (s *fakeSPISlave) onCLK(l gpio.Level) {
+	if !s.selected {
+		return
+	}
+	leading := l != gpio.Level(s.mode&spi.Mode2 == spi.Mode2)
+	if leading == (s.mode&spi.Mode1 == 0) {
+		s.sample()
+	} else {
+		s.drive()
+	}
+}
+
+func (s *fakeSPISlave) mask(bit int) byte {
+	if s.mode&spi.LSBFirst != 0 {
+		return 1 << uint(bit)
+	}
+	return 0x80 >> uint(bit)
+}
+
+func (s *fakeSPISlave) sample() {
+	if s.mosi {
+		s.cur |= s.mask(s.bit)
+	}
+	if s.bit++; s.bit == 8 {
+		s.rx = append(s.rx, s.cur)
+		s.out, s.outBit = s.cur, 0
+		s.bit, s.cur = 0, 0
+	}
+}
+
+func (s *fakeSPISlave) drive() {
+	s.miso = s.out&s.mask(s.outBit) != 0
+	s.outBit++
+}
+
+// fakeSPIPin is one of the lines of a fakeSPISlave.
+type fakeSPIPin struct {
+	d    *fakeSPISlave
+	name string
+}
+
+func (p *fakeSPIPin) String() string {
+	return p.name
+}
+
+func (p *fakeSPIPin) Halt() error {
+	return nil
+}
+
+func (p *fakeSPIPin) Name() string {
+	return p.name
+}
+
+func (p *fakeSPIPin) Number() int {
+	return -1
+}
+
+func (p *fakeSPIPin) Function() string {
+	return ""
+}
+
+func (p *fakeSPIPin) In(pull gpio.Pull, edge gpio.Edge) error {
+	return nil
+}
+
+func (p *fakeSPIPin) Read() gpio.Level {
+	return p.d.miso
+}
+
+func (p *fakeSPIPin) WaitForEdge(timeout time.Duration) bool {
+	return false
+}
+
+func (p *fakeSPIPin) Pull() gpio.Pull {
+	return gpio.PullNoChange
+}
+
+func (p *fakeSPIPin) DefaultPull() gpio.Pull {
+	return gpio.PullNoChange
+}
+
+func (p *fakeSPIPin) Out(l gpio.Level) error {
+	switch p.name {
+	case "CLK":
+		if l != p.d.clk {
+			p.d.clk = l
+			p.d.onCLK(l)
+		}
+	case "MOSI":
+		p.d.mosi = l
+	case "CS":
+		p.d.onCS(l)
+	}
+	return nil
+}
+
+func (p *fakeSPIPin) PWM(duty gpio.Duty, f physic.Frequency) error {
+	return nil
+}
+
+var _ gpio.PinIO = &fakeSPIPin{}
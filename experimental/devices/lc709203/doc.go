@@ -0,0 +1,19 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package lc709203 controls an ON Semiconductor LC709203F battery fuel gauge
+// over an i2c bus.
+//
+// The device may be sleeping, in which case it ignores the first transaction;
+// New wakes it up by setting it in operational mode.
+//
+// Registers are read with a single i2c.Bus Tx, the write of the command
+// followed by a repeated START and the read, so the driver works on any bus
+// implementing it, including a bit-banged one from
+// periph.io/x/periph/experimental/devices/bitbang.
+//
+// Datasheet
+//
+// https://www.onsemi.com/pub/Collateral/LC709203F-D.PDF
+package lc709203
@@ -0,0 +1,71 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package lc709203_test
+
+import (
+	"fmt"
+	"log"
+
+	"periph.io/x/periph/conn/i2c/i2creg"
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"periph.io/x/periph/experimental/devices/lc709203"
+	"periph.io/x/periph/host"
+)
+
+func Example() {
+	// Make sure periph is initialized.
+	if _, err := host.Init(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Open default I²C bus.
+	bus, err := i2creg.Open("")
+	if err != nil {
+		log.Fatalf("failed to open I²C: %v", err)
+	}
+	defer bus.Close()
+
+	// Create a new fuel gauge.
+	dev, err := lc709203.New(bus, &lc709203.DefaultOpts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Read the state of charge.
+	rsoc, err := dev.RSOC()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%s: %d%%\n", dev, rsoc)
+}
+
+func ExampleDev_RSOC() {
+	// Replay the responses of a device so the example runs anywhere. Use
+	// i2creg.Open("") as in Example to open an actual bus, or a bit-banged one
+	// from periph.io/x/periph/experimental/devices/bitbang.
+	bus := &i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			// New wakes the device up then reads its version. Each register
+			// access is 16-bit little endian followed by a CRC-8.
+			{Addr: 0x0B, W: []byte{0x15, 0x01, 0x00, 0x64}},
+			{Addr: 0x0B, W: []byte{0x11}, R: []byte{0x17, 0x27, 0x75}},
+			// RSOC.
+			{Addr: 0x0B, W: []byte{0x0D}, R: []byte{0x55, 0x00, 0x7E}},
+		},
+	}
+	defer bus.Close()
+
+	dev, err := lc709203.New(bus, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rsoc, err := dev.RSOC()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%s: %d%%\n", dev, rsoc)
+	// Output:
+	// LC709203F: 85%
+}
@@ -0,0 +1,932 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package lc709203
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"periph.io/x/periph/conn"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/physic"
+)
+
+// I2CAddr is the fixed 7-bit address of the device.
+const I2CAddr uint16 = 0x0B
+
+// Opts holds the configuration options.
+type Opts struct {
+	// Addr is the 7-bit I²C address of the device, not shifted. 0 means
+	// I2CAddr.
+	Addr uint16
+	// APA is the adjustment pack application, see SetAPA. When not 0, New
+	// applies the fields below then starts the RSOC calculation over, so the
+	// device is ready to be read. When 0, the device configuration is left
+	// untouched and the fields below must also be 0.
+	APA uint8
+	// Profile is the battery profile, see SetBatteryProfile.
+	Profile int
+	// ThermistorB is the B-constant of the thermistor, see SetThermistorB. 0
+	// leaves it untouched.
+	ThermistorB uint16
+	// TempMode selects how the device obtains the cell temperature.
+	TempMode TemperatureMode
+}
+
+// DefaultOpts is the recommended default options.
+var DefaultOpts = Opts{Addr: I2CAddr}
+
+// TemperatureMode selects how the device obtains the cell temperature.
+type TemperatureMode uint16
+
+// Valid TemperatureMode values.
+const (
+	// I2CMode means the host writes the temperature with SetTemperature.
+	I2CMode TemperatureMode = 0
+	// ThermistorMode means the device measures the temperature with a
+	// thermistor connected to TSENSE.
+	ThermistorMode TemperatureMode = 1
+)
+
+func (t TemperatureMode) String() string {
+	switch t {
+	case I2CMode:
+		return "i2c"
+	case ThermistorMode:
+		return "thermistor"
+	default:
+		return fmt.Sprintf("unknown(0x%X)", uint16(t))
+	}
+}
+
+// CurrentDirection hints the device about the direction of the current.
+type CurrentDirection uint16
+
+// Valid CurrentDirection values.
+const (
+	// Auto means the device detects the direction itself.
+	Auto CurrentDirection = 0
+	// Charge means the battery is charging.
+	Charge CurrentDirection = 1
+	// Discharge means the battery is discharging.
+	Discharge CurrentDirection = 0xFFFF
+)
+
+func (c CurrentDirection) String() string {
+	switch c {
+	case Auto:
+		return "auto"
+	case Charge:
+		return "charge"
+	case Discharge:
+		return "discharge"
+	default:
+		return fmt.Sprintf("unknown(0x%X)", uint16(c))
+	}
+}
+
+// Adjustment pack application (APA) values for common pack capacities, as
+// listed in the datasheet.
+const (
+	APA100mAh  uint8 = 0x08
+	APA200mAh  uint8 = 0x0B
+	APA500mAh  uint8 = 0x10
+	APA1000mAh uint8 = 0x19
+	APA2000mAh uint8 = 0x2D
+	APA3000mAh uint8 = 0x36
+)
+
+// PowerMode is the device power mode.
+type PowerMode uint16
+
+// Valid PowerMode values.
+const (
+	Operational PowerMode = 1
+	Sleep       PowerMode = 2
+)
+
+func (p PowerMode) String() string {
+	switch p {
+	case Operational:
+		return "operational"
+	case Sleep:
+		return "sleep"
+	default:
+		return fmt.Sprintf("unknown(0x%X)", uint16(p))
+	}
+}
+
+// New opens a handle to an LC709203F fuel gauge.
+//
+// opts may be nil, in which case DefaultOpts is used.
+func New(bus i2c.Bus, opts *Opts) (*Dev, error) {
+	if opts == nil {
+		opts = &DefaultOpts
+	}
+	addr := opts.Addr
+	if addr == 0 {
+		addr = I2CAddr
+	}
+	if addr > 0x7F {
+		return nil, fmt.Errorf("lc709203: invalid 7-bit address 0x%X", addr)
+	}
+	if opts.APA == 0 && (opts.Profile != 0 || opts.ThermistorB != 0 || opts.TempMode != I2CMode) {
+		return nil, errors.New("lc709203: Opts.APA is required to apply Profile, ThermistorB or TempMode")
+	}
+	d := &Dev{c: i2c.Dev{Bus: bus, Addr: addr}}
+	if err := d.wake(); err != nil {
+		return nil, err
+	}
+	// Make sure this is an LC709203F.
+	v, err := d.Version()
+	if err != nil {
+		return nil, err
+	}
+	if v == 0 || v == 0xFFFF {
+		return nil, fmt.Errorf("lc709203: unexpected IC version 0x%04X", v)
+	}
+	if opts.APA != 0 {
+		if err := d.init(opts); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Dev is a handle to an LC709203F fuel gauge.
+type Dev struct {
+	c i2c.Dev // c.Addr is the address from Opts.
+
+	mu        sync.Mutex
+	stop      chan struct{}
+	alarmStop chan struct{}
+	wg        sync.WaitGroup // SenseContinuous goroutine.
+	alarmWG   sync.WaitGroup // WatchAlarm goroutine.
+}
+
+// String implements conn.Resource.
+func (d *Dev) String() string {
+	return "LC709203F"
+}
+
+// CellVoltage returns the cell voltage.
+func (d *Dev) CellVoltage() (physic.ElectricPotential, error) {
+	v, err := d.ReadRegister(regCellVoltage)
+	if err != nil {
+		return 0, err
+	}
+	return physic.ElectricPotential(v) * physic.MilliVolt, nil
+}
+
+// RSOC returns the relative state of charge, in percent from 0 to 100.
+func (d *Dev) RSOC() (int, error) {
+	v, err := d.ReadRegister(regRSOC)
+	if err != nil {
+		return 0, err
+	}
+	if v > 100 {
+		return 0, fmt.Errorf("lc709203: invalid RSOC %d", v)
+	}
+	return int(v), nil
+}
+
+// ITE returns the indicator to empty, in tenth of percent from 0 to 1000.
+func (d *Dev) ITE() (int, error) {
+	v, err := d.ReadRegister(regITE)
+	if err != nil {
+		return 0, err
+	}
+	if v > 1000 {
+		return 0, fmt.Errorf("lc709203: invalid ITE %d", v)
+	}
+	return int(v), nil
+}
+
+// Battery is a snapshot of the battery state.
+type Battery struct {
+	// Voltage is the cell voltage.
+	Voltage physic.ElectricPotential
+	// RSOC is the relative state of charge, in percent from 0 to 100.
+	RSOC int
+	// ITE is the indicator to empty, in tenth of percent from 0 to 1000.
+	ITE int
+	// Temperature is the cell temperature.
+	Temperature physic.Temperature
+}
+
+// Sense returns the cell voltage, the RSOC, the ITE and the cell temperature
+// read back to back.
+//
+// It stops at the first error.
+func (d *Dev) Sense() (Battery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		return Battery{}, errors.New("lc709203: already sensing continuously")
+	}
+	return d.sense()
+}
+
+// SenseContinuous returns a Battery snapshot on a continuous basis, the first
+// one right away then one every interval.
+//
+// The application must call Halt() to stop the sensing when done and close the
+// channel. The channel is also closed on the first error.
+//
+// It's the responsibility of the caller to retrieve the values from the
+// channel as fast as possible, otherwise the interval may not be respected.
+func (d *Dev) SenseContinuous(interval time.Duration) (<-chan Battery, error) {
+	if interval <= 0 {
+		return nil, errors.New("lc709203: invalid interval")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+		d.wg.Wait()
+	}
+	sensing := make(chan Battery)
+	// The goroutine must not read d.stop, which is reset by Halt.
+	stop := make(chan struct{})
+	d.stop = stop
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(sensing)
+		d.sensingContinuous(interval, sensing, stop)
+	}()
+	return sensing, nil
+}
+
+// Temperature returns the cell temperature.
+//
+// In I2CMode, this is the value last set with SetTemperature. In
+// ThermistorMode, this is the temperature measured on TSENSE.
+func (d *Dev) Temperature() (physic.Temperature, error) {
+	v, err := d.ReadRegister(regCellTemperature)
+	if err != nil {
+		return 0, err
+	}
+	return physic.Temperature(v) * 100 * physic.MilliKelvin, nil
+}
+
+// SetTemperature sets the cell temperature as measured by the host.
+//
+// It is only effective in I2CMode. The supported range is -20°C to 60°C.
+func (d *Dev) SetTemperature(t physic.Temperature) error {
+	v := (t + 50*physic.MilliKelvin) / (100 * physic.MilliKelvin)
+	if v < minTemperature || v > maxTemperature {
+		return errors.New("lc709203: temperature out of range")
+	}
+	return d.WriteRegister(regCellTemperature, uint16(v))
+}
+
+// SetTemperatureMode selects how the device obtains the cell temperature.
+//
+// Only bit 0 of the Status Bit register is changed; the other bits are
+// written back as read.
+func (d *Dev) SetTemperatureMode(m TemperatureMode) error {
+	if err := checkTemperatureMode(m); err != nil {
+		return err
+	}
+	v, err := d.ReadRegister(regStatusBit)
+	if err != nil {
+		return err
+	}
+	return d.WriteRegister(regStatusBit, v&^statusThermistorMode|uint16(m))
+}
+
+// SetThermistorMode is a shorthand to select ThermistorMode or I2CMode.
+//
+// The mode is the bit 0 of the Status Bit register (0x16); 0x07 is the
+// Initial RSOC register. Set the B-constant with SetThermistorB first.
+func (d *Dev) SetThermistorMode(enable bool) error {
+	if enable {
+		return d.SetTemperatureMode(ThermistorMode)
+	}
+	return d.SetTemperatureMode(I2CMode)
+}
+
+// SetThermistorB sets the B-constant of the thermistor connected to TSENSE,
+// for example 3435 for a common 10kΩ NTC.
+//
+// It is only used in ThermistorMode.
+func (d *Dev) SetThermistorB(b uint16) error {
+	if b == 0 {
+		return errors.New("lc709203: invalid thermistor B-constant")
+	}
+	return d.WriteRegister(regThermistorB, b)
+}
+
+// ThermistorB returns the B-constant of the thermistor.
+func (d *Dev) ThermistorB() (uint16, error) {
+	return d.ReadRegister(regThermistorB)
+}
+
+// SetPowerMode sets the device power mode.
+//
+// In Sleep mode, the device stops measuring to reduce its consumption.
+func (d *Dev) SetPowerMode(m PowerMode) error {
+	if err := checkPowerMode(m); err != nil {
+		return err
+	}
+	return d.WriteRegister(regICPowerMode, uint16(m))
+}
+
+// PowerMode returns the device power mode.
+func (d *Dev) PowerMode() (PowerMode, error) {
+	v, err := d.ReadRegister(regICPowerMode)
+	if err != nil {
+		return 0, err
+	}
+	m := PowerMode(v)
+	if m != Operational && m != Sleep {
+		return 0, fmt.Errorf("lc709203: invalid power mode %d", v)
+	}
+	return m, nil
+}
+
+// SetCurrentDirection sets the direction of the current.
+//
+// Setting the actual direction instead of Auto improves the RSOC accuracy.
+func (d *Dev) SetCurrentDirection(c CurrentDirection) error {
+	if c != Auto && c != Charge && c != Discharge {
+		return errors.New("lc709203: invalid current direction")
+	}
+	return d.WriteRegister(regCurrentDirection, uint16(c))
+}
+
+// CurrentDirection returns the direction of the current.
+func (d *Dev) CurrentDirection() (CurrentDirection, error) {
+	v, err := d.ReadRegister(regCurrentDirection)
+	if err != nil {
+		return 0, err
+	}
+	c := CurrentDirection(v)
+	if c != Auto && c != Charge && c != Discharge {
+		return 0, fmt.Errorf("lc709203: invalid current direction 0x%X", v)
+	}
+	return c, nil
+}
+
+// SetLowRSOCAlarm sets the RSOC threshold, in percent, below which the ALARMB
+// pin is asserted.
+//
+// 0 disables the alarm.
+func (d *Dev) SetLowRSOCAlarm(percent int) error {
+	if err := checkLowRSOCAlarm(percent); err != nil {
+		return err
+	}
+	return d.WriteRegister(regAlarmLowRSOC, uint16(percent))
+}
+
+// LowRSOCAlarm returns the RSOC alarm threshold, in percent.
+//
+// 0 means the alarm is disabled.
+func (d *Dev) LowRSOCAlarm() (int, error) {
+	v, err := d.ReadRegister(regAlarmLowRSOC)
+	if err != nil {
+		return 0, err
+	}
+	return int(v), nil
+}
+
+// SetLowVoltageAlarm sets the cell voltage below which the ALARMB pin is
+// asserted, independently of the RSOC.
+//
+// The threshold is rounded to the millivolt and must be within the cell
+// voltage range, from 2.5V to 5V. 0 disables the alarm.
+func (d *Dev) SetLowVoltageAlarm(v physic.ElectricPotential) error {
+	if err := checkLowVoltageAlarm(v); err != nil {
+		return err
+	}
+	return d.WriteRegister(regAlarmLowVoltage, uint16((v+physic.MilliVolt/2)/physic.MilliVolt))
+}
+
+// LowVoltageAlarm returns the cell voltage alarm threshold.
+//
+// 0 means the alarm is disabled.
+func (d *Dev) LowVoltageAlarm() (physic.ElectricPotential, error) {
+	v, err := d.ReadRegister(regAlarmLowVoltage)
+	if err != nil {
+		return 0, err
+	}
+	return physic.ElectricPotential(v) * physic.MilliVolt, nil
+}
+
+// AlarmStatus returns which alarm conditions are currently asserted.
+//
+// The LC709203F has no register flagging them, so they are evaluated the way
+// the device drives ALARMB: the RSOC is below the threshold set with
+// SetLowRSOCAlarm, or the cell voltage is below the one set with
+// SetLowVoltageAlarm. A disabled alarm is never asserted.
+func (d *Dev) AlarmStatus() (lowRSOC, lowVoltage bool, err error) {
+	percent, err := d.LowRSOCAlarm()
+	if err != nil {
+		return false, false, err
+	}
+	if percent != 0 {
+		r, err := d.RSOC()
+		if err != nil {
+			return false, false, err
+		}
+		lowRSOC = r < percent
+	}
+	mv, err := d.LowVoltageAlarm()
+	if err != nil {
+		return false, false, err
+	}
+	if mv != 0 {
+		v, err := d.CellVoltage()
+		if err != nil {
+			return false, false, err
+		}
+		lowVoltage = v < mv
+	}
+	return lowRSOC, lowVoltage, nil
+}
+
+// Status is the decoded Status Bit register (0x16).
+//
+// On the LC709203F, only the bit 0 is defined, which selects the temperature
+// mode. Unlike the LC709204F, the device has no initialization or alarm flag.
+type Status struct {
+	// TempMode is the temperature mode set with SetTemperatureMode.
+	TempMode TemperatureMode
+	// Raw is the register value.
+	Raw uint16
+}
+
+// Status returns the device status.
+func (d *Dev) Status() (Status, error) {
+	v, err := d.ReadRegister(regStatusBit)
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{TempMode: TemperatureMode(v & statusThermistorMode), Raw: v}, nil
+}
+
+// AlarmEvent is an assertion of the ALARMB pin.
+type AlarmEvent struct {
+	// LowRSOC is set when the RSOC is below the threshold set with
+	// SetLowRSOCAlarm.
+	LowRSOC bool
+	// LowVoltage is set when the cell voltage is below the threshold set with
+	// SetLowVoltageAlarm.
+	LowVoltage bool
+}
+
+// WatchAlarm watches the ALARMB pin of the device, connected to pin, and
+// returns an AlarmEvent each time it is asserted.
+//
+// ALARMB is an active low open drain output, so pin is configured as an input
+// with a pull up and falling edge detection. On each edge, AlarmStatus is
+// called to tell which alarm conditions are asserted.
+//
+// The application must call Halt() to stop watching when done and close the
+// channel. The channel is also closed on the first error.
+func (d *Dev) WatchAlarm(pin gpio.PinIO) (<-chan AlarmEvent, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.alarmStop != nil {
+		return nil, errors.New("lc709203: already watching the alarm pin")
+	}
+	if err := pin.In(gpio.PullUp, gpio.FallingEdge); err != nil {
+		return nil, fmt.Errorf("lc709203: %v", err)
+	}
+	events := make(chan AlarmEvent)
+	stop := make(chan struct{})
+	d.alarmStop = stop
+	d.alarmWG.Add(1)
+	go func() {
+		defer d.alarmWG.Done()
+		defer close(events)
+		d.watchingAlarm(pin, events, stop)
+	}()
+	return events, nil
+}
+
+// SetAPA sets the adjustment pack application, which depends on the battery
+// pack capacity.
+//
+// Use one of the APAxxxmAh constants, or a value from the datasheet.
+func (d *Dev) SetAPA(apa uint8) error {
+	return d.WriteRegister(regAPA, uint16(apa))
+}
+
+// SetBatteryProfile selects the battery profile, either 0 or 1.
+//
+// The profile to use depends on the battery chemistry; refer to the
+// datasheet.
+func (d *Dev) SetBatteryProfile(profile int) error {
+	if err := checkBatteryProfile(profile); err != nil {
+		return err
+	}
+	return d.WriteRegister(regChangeOfParameter, uint16(profile))
+}
+
+// Config is the configuration of the device.
+type Config struct {
+	// APA is the adjustment pack application, see SetAPA.
+	APA uint8
+	// Profile is the battery profile, see SetBatteryProfile.
+	Profile int
+	// LowRSOCAlarm is the RSOC alarm threshold in percent, see
+	// SetLowRSOCAlarm.
+	LowRSOCAlarm int
+	// LowVoltageAlarm is the cell voltage alarm threshold, see
+	// SetLowVoltageAlarm.
+	LowVoltageAlarm physic.ElectricPotential
+	// TempMode selects how the device obtains the cell temperature.
+	TempMode TemperatureMode
+	// PowerMode is the device power mode.
+	PowerMode PowerMode
+}
+
+// Config reads the device configuration.
+//
+// It stops at the first error.
+func (d *Dev) Config() (Config, error) {
+	var c Config
+	v, err := d.ReadRegister(regAPA)
+	if err != nil {
+		return Config{}, err
+	}
+	c.APA = uint8(v)
+	if v, err = d.ReadRegister(regChangeOfParameter); err != nil {
+		return Config{}, err
+	}
+	c.Profile = int(v)
+	if c.LowRSOCAlarm, err = d.LowRSOCAlarm(); err != nil {
+		return Config{}, err
+	}
+	if c.LowVoltageAlarm, err = d.LowVoltageAlarm(); err != nil {
+		return Config{}, err
+	}
+	if v, err = d.ReadRegister(regStatusBit); err != nil {
+		return Config{}, err
+	}
+	c.TempMode = TemperatureMode(v & statusThermistorMode)
+	if c.PowerMode, err = d.PowerMode(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// SetConfig writes the device configuration.
+//
+// The whole configuration is validated before any register is written. The
+// device is set in operational mode first, then the APA, the battery profile,
+// the temperature mode and the alarm thresholds are written. The power mode is
+// set last, so the device can be put in Sleep mode. It stops at the first
+// error; the error returned names the setting that failed.
+func (d *Dev) SetConfig(c Config) error {
+	checks := []step{
+		{"set battery profile", func() error { return checkBatteryProfile(c.Profile) }},
+		{"set temperature mode", func() error { return checkTemperatureMode(c.TempMode) }},
+		{"set RSOC alarm", func() error { return checkLowRSOCAlarm(c.LowRSOCAlarm) }},
+		{"set voltage alarm", func() error { return checkLowVoltageAlarm(c.LowVoltageAlarm) }},
+		{"set power mode", func() error { return checkPowerMode(c.PowerMode) }},
+	}
+	if err := runSteps(checks); err != nil {
+		return err
+	}
+	steps := []step{
+		{"set operational mode", func() error { return d.SetPowerMode(Operational) }},
+		{"set APA", func() error { return d.SetAPA(c.APA) }},
+		{"set battery profile", func() error { return d.SetBatteryProfile(c.Profile) }},
+		{"set temperature mode", func() error { return d.SetTemperatureMode(c.TempMode) }},
+		{"set RSOC alarm", func() error { return d.SetLowRSOCAlarm(c.LowRSOCAlarm) }},
+		{"set voltage alarm", func() error { return d.SetLowVoltageAlarm(c.LowVoltageAlarm) }},
+		{"set power mode", func() error {
+			if c.PowerMode == Operational {
+				return nil
+			}
+			return d.SetPowerMode(c.PowerMode)
+		}},
+	}
+	return runSteps(steps)
+}
+
+// Version returns the IC version.
+func (d *Dev) Version() (uint16, error) {
+	return d.ReadRegister(regICVersion)
+}
+
+// InitRSOC starts the RSOC calculation over, based on the current cell
+// voltage.
+//
+// This is the quick start procedure documented in the datasheet; call it
+// after SetAPA and SetBatteryProfile.
+func (d *Dev) InitRSOC() error {
+	return d.WriteRegister(regInitialRSOC, initRSOC)
+}
+
+// QuickStart does the initialization sequence recommended after a battery
+// pack is connected, so the device gauges it again.
+//
+// It sets the device in operational mode, sets the APA and the battery
+// profile, then starts the RSOC calculation over with both the Before RSOC
+// and the Initial RSOC commands.
+func (d *Dev) QuickStart(apa uint8, profile int) error {
+	if err := d.SetPowerMode(Operational); err != nil {
+		return err
+	}
+	if err := d.SetAPA(apa); err != nil {
+		return err
+	}
+	if err := d.SetBatteryProfile(profile); err != nil {
+		return err
+	}
+	if err := d.WriteRegister(regBeforeRSOC, initRSOC); err != nil {
+		return err
+	}
+	return d.InitRSOC()
+}
+
+// CRC8 calculates the SMBus packet error code (PEC) as used by the device.
+//
+// It is a CRC-8 with the polynomial x⁸+x²+x+1 (0x07) and an initial value of
+// 0.
+func CRC8(b []byte) byte {
+	var c byte
+	for _, v := range b {
+		c ^= v
+		for i := 0; i < 8; i++ {
+			if c&0x80 != 0 {
+				c = c<<1 ^ 0x07
+			} else {
+				c <<= 1
+			}
+		}
+	}
+	return c
+}
+
+// ReadRegister reads the 16-bit little endian register cmd.
+//
+// It is meant for registers not otherwise supported by this package. The
+// register is read with a repeated START; the device appends a CRC-8 to the
+// two data bytes, computed over the whole transaction including both address
+// bytes, which is verified.
+func (d *Dev) ReadRegister(cmd byte) (uint16, error) {
+	var b [3]byte
+	if err := d.c.Tx([]byte{cmd}, b[:]); err != nil {
+		return 0, fmt.Errorf("lc709203: %v", err)
+	}
+	a := byte(d.c.Addr << 1)
+	if CRC8([]byte{a, cmd, a | 1, b[0], b[1]}) != b[2] {
+		return 0, errCRC
+	}
+	return binary.LittleEndian.Uint16(b[:2]), nil
+}
+
+// WriteRegister writes val to the 16-bit little endian register cmd.
+//
+// It is meant for registers not otherwise supported by this package. The
+// device ignores writes that are not followed by a valid CRC-8, computed over
+// the address byte, the command and the data, which is appended.
+func (d *Dev) WriteRegister(cmd byte, val uint16) error {
+	w := []byte{cmd, byte(val), byte(val >> 8), 0}
+	w[3] = CRC8([]byte{byte(d.c.Addr << 1), w[0], w[1], w[2]})
+	if err := d.c.Tx(w, nil); err != nil {
+		return fmt.Errorf("lc709203: %v", err)
+	}
+	return nil
+}
+
+// Halt stops a continuous sensing started with SenseContinuous() and the
+// alarm pin watch started with WatchAlarm(), and closes their channels.
+//
+// Halt implements conn.Resource.
+func (d *Dev) Halt() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+	if d.alarmStop != nil {
+		close(d.alarmStop)
+		d.alarmStop = nil
+	}
+	d.wg.Wait()
+	d.alarmWG.Wait()
+	return nil
+}
+
+//
+
+// Registers, page 6.
+const (
+	regBeforeRSOC        byte = 0x04
+	regThermistorB       byte = 0x06
+	regInitialRSOC       byte = 0x07
+	regCellTemperature   byte = 0x08
+	regCellVoltage       byte = 0x09
+	regCurrentDirection  byte = 0x0A
+	regAPA               byte = 0x0B
+	regAPTHED            byte = 0x0C
+	regRSOC              byte = 0x0D
+	regITE               byte = 0x0F
+	regICVersion         byte = 0x11
+	regChangeOfParameter byte = 0x12
+	regAlarmLowRSOC      byte = 0x13
+	regAlarmLowVoltage   byte = 0x14
+	regICPowerMode       byte = 0x15
+	regStatusBit         byte = 0x16
+	regNumberOfParameter byte = 0x1A
+)
+
+// initRSOC is the magic value to write to regBeforeRSOC and regInitialRSOC.
+const initRSOC uint16 = 0xAA55
+
+// statusThermistorMode is the TemperatureMode, the only flag of the Status
+// Bit register.
+const statusThermistorMode uint16 = 1 << 0
+
+// Cell voltage range of the low voltage alarm.
+const (
+	minVoltageAlarm = 2500 * physic.MilliVolt
+	maxVoltageAlarm = 5000 * physic.MilliVolt
+)
+
+// Cell temperature range, in 0.1K units.
+const (
+	minTemperature = 0x09E4 // -20°C
+	maxTemperature = 0x0D04 // 60°C
+)
+
+// sense reads a Battery snapshot.
+func (d *Dev) sense() (Battery, error) {
+	var b Battery
+	var err error
+	if b.Voltage, err = d.CellVoltage(); err != nil {
+		return Battery{}, err
+	}
+	if b.RSOC, err = d.RSOC(); err != nil {
+		return Battery{}, err
+	}
+	if b.ITE, err = d.ITE(); err != nil {
+		return Battery{}, err
+	}
+	if b.Temperature, err = d.Temperature(); err != nil {
+		return Battery{}, err
+	}
+	return b, nil
+}
+
+func (d *Dev) sensingContinuous(interval time.Duration, sensing chan<- Battery, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		// d.mu is not held here, Halt() holds it while waiting for this
+		// goroutine; Sense() refuses to run concurrently anyway.
+		b, err := d.sense()
+		if err != nil {
+			log.Printf("%s: failed to sense: %v", d, err)
+			return
+		}
+		select {
+		case sensing <- b:
+		case <-stop:
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// alarmPollInterval is how long watchingAlarm waits for an edge before
+// checking if it was stopped.
+const alarmPollInterval = 100 * time.Millisecond
+
+func (d *Dev) watchingAlarm(pin gpio.PinIO, events chan<- AlarmEvent, stop <-chan struct{}) {
+	// Disable edge detection when done.
+	defer pin.In(gpio.PullUp, gpio.NoEdge)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !pin.WaitForEdge(alarmPollInterval) {
+			continue
+		}
+		lowRSOC, lowVoltage, err := d.AlarmStatus()
+		if err != nil {
+			log.Printf("%s: failed to read the alarm status: %v", d, err)
+			return
+		}
+		select {
+		case events <- AlarmEvent{LowRSOC: lowRSOC, LowVoltage: lowVoltage}:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// wake puts the device in operational mode.
+//
+// A sleeping device may not acknowledge the first transaction so it is
+// retried once.
+func (d *Dev) wake() error {
+	if err := d.SetPowerMode(Operational); err == nil {
+		return nil
+	}
+	return d.SetPowerMode(Operational)
+}
+
+// init applies the configuration in opts then starts the RSOC calculation
+// over.
+//
+// The error returned names the step that failed.
+func (d *Dev) init(opts *Opts) error {
+	steps := []step{
+		{"set APA", func() error { return d.SetAPA(opts.APA) }},
+		{"set battery profile", func() error { return d.SetBatteryProfile(opts.Profile) }},
+		{"set thermistor B-constant", func() error {
+			if opts.ThermistorB == 0 {
+				return nil
+			}
+			return d.SetThermistorB(opts.ThermistorB)
+		}},
+		{"set temperature mode", func() error { return d.SetTemperatureMode(opts.TempMode) }},
+		{"init RSOC", func() error {
+			if err := d.WriteRegister(regBeforeRSOC, initRSOC); err != nil {
+				return err
+			}
+			return d.InitRSOC()
+		}},
+	}
+	return runSteps(steps)
+}
+
+// step is a named configuration step.
+type step struct {
+	name string
+	f    func() error
+}
+
+// runSteps runs each step in order and stops at the first error, which is
+// prefixed with the name of the step.
+func runSteps(steps []step) error {
+	for _, s := range steps {
+		if err := s.f(); err != nil {
+			return fmt.Errorf("lc709203: %s: %s", s.name, strings.TrimPrefix(err.Error(), "lc709203: "))
+		}
+	}
+	return nil
+}
+
+func checkBatteryProfile(profile int) error {
+	if profile != 0 && profile != 1 {
+		return errors.New("lc709203: invalid battery profile")
+	}
+	return nil
+}
+
+func checkTemperatureMode(m TemperatureMode) error {
+	if m != I2CMode && m != ThermistorMode {
+		return errors.New("lc709203: invalid temperature mode")
+	}
+	return nil
+}
+
+func checkLowRSOCAlarm(percent int) error {
+	if percent < 0 || percent > 100 {
+		return errors.New("lc709203: RSOC alarm out of range")
+	}
+	return nil
+}
+
+func checkLowVoltageAlarm(v physic.ElectricPotential) error {
+	mv := (v + physic.MilliVolt/2) / physic.MilliVolt * physic.MilliVolt
+	if v < 0 || (mv != 0 && (mv < minVoltageAlarm || mv > maxVoltageAlarm)) {
+		return fmt.Errorf("lc709203: voltage alarm %s out of range, must be 0 or between %s and %s", v, minVoltageAlarm, maxVoltageAlarm)
+	}
+	return nil
+}
+
+func checkPowerMode(m PowerMode) error {
+	if m != Operational && m != Sleep {
+		return errors.New("lc709203: invalid power mode")
+	}
+	return nil
+}
+
+var errCRC = errors.New("lc709203: invalid CRC")
+
+var _ conn.Resource = &Dev{}
@@ -0,0 +1,1142 @@
+// Copyright 2019 The Periph Authors. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package lc709203
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpiotest"
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"periph.io/x/periph/conn/physic"
+)
+
+func TestCellVoltage(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regCellVoltage}, R: readResp(regCellVoltage, 0x1068)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.CellVoltage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 4200*physic.MilliVolt {
+		t.Fatal(v)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCellVoltage_CRC(t *testing.T) {
+	r := readResp(regCellVoltage, 0x1068)
+	r[2]++
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regCellVoltage}, R: r},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CellVoltage(); err != errCRC {
+		t.Fatal(err)
+	}
+}
+
+func TestRSOC(t *testing.T) {
+	data := []struct {
+		v        uint16
+		expected int
+		err      bool
+	}{
+		{0, 0, false},
+		{100, 100, false},
+		{101, 0, true},
+		{0xFFFF, 0, true},
+	}
+	for _, line := range data {
+		bus := i2ctest.Playback{
+			Ops: []i2ctest.IO{
+				wakeOp, versionOp,
+				{Addr: 0x0B, W: []byte{regRSOC}, R: readResp(regRSOC, line.v)},
+			},
+		}
+		d, err := New(&bus, &DefaultOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.RSOC()
+		if (err != nil) != line.err {
+			t.Fatalf("%#x: %v", line.v, err)
+		}
+		if v != line.expected {
+			t.Fatalf("%#x: %d != %d", line.v, v, line.expected)
+		}
+	}
+}
+
+func TestITE(t *testing.T) {
+	data := []struct {
+		v        uint16
+		expected int
+		err      bool
+	}{
+		{0, 0, false},
+		{1000, 1000, false},
+		{0xFFFF, 0, true},
+	}
+	for _, line := range data {
+		bus := i2ctest.Playback{
+			Ops: []i2ctest.IO{
+				wakeOp, versionOp,
+				{Addr: 0x0B, W: []byte{regITE}, R: readResp(regITE, line.v)},
+			},
+		}
+		d, err := New(&bus, &DefaultOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.ITE()
+		if (err != nil) != line.err {
+			t.Fatalf("%#x: %v", line.v, err)
+		}
+		if v != line.expected {
+			t.Fatalf("%#x: %d != %d", line.v, v, line.expected)
+		}
+	}
+}
+
+func TestSense(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regCellVoltage}, R: readResp(regCellVoltage, 0x0E74)},
+			{Addr: 0x0B, W: []byte{regRSOC}, R: readResp(regRSOC, 42)},
+			{Addr: 0x0B, W: []byte{regITE}, R: readResp(regITE, 421)},
+			{Addr: 0x0B, W: []byte{regCellTemperature}, R: readResp(regCellTemperature, 0x0BA6)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.Sense()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Battery{
+		Voltage:     3700 * physic.MilliVolt,
+		RSOC:        42,
+		ITE:         421,
+		Temperature: 2982 * 100 * physic.MilliKelvin,
+	}
+	if b != expected {
+		t.Fatalf("%#v != %#v", b, expected)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSense_Fail(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regCellVoltage}, R: readResp(regCellVoltage, 0x0E74)},
+			{Addr: 0x0B, W: []byte{regRSOC}, R: readResp(regRSOC, 101)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := d.Sense(); err == nil || b != (Battery{}) {
+		t.Fatal(b, err)
+	}
+}
+
+func TestSenseContinuous(t *testing.T) {
+	ops := []i2ctest.IO{wakeOp, versionOp}
+	// The goroutine senses at most 3 times before blocking on the channel.
+	for i := 0; i < 3; i++ {
+		ops = append(ops,
+			i2ctest.IO{Addr: 0x0B, W: []byte{regCellVoltage}, R: readResp(regCellVoltage, 0x0E74)},
+			i2ctest.IO{Addr: 0x0B, W: []byte{regRSOC}, R: readResp(regRSOC, uint16(42+i))},
+			i2ctest.IO{Addr: 0x0B, W: []byte{regITE}, R: readResp(regITE, 421)},
+			i2ctest.IO{Addr: 0x0B, W: []byte{regCellTemperature}, R: readResp(regCellTemperature, 0x0BA6)})
+	}
+	bus := i2ctest.Playback{Ops: ops, DontPanic: true}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SenseContinuous(0); err == nil {
+		t.Fatal("expected error")
+	}
+	c, err := d.SenseContinuous(time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if b := <-c; b.RSOC != 42+i {
+			t.Fatalf("#%d: %#v", i, b)
+		}
+	}
+	if _, err := d.Sense(); err == nil {
+		t.Fatal("expected error while sensing continuously")
+	}
+	if err := d.Halt(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-c; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+	if err := d.Halt(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSenseContinuous_WatchAlarm(t *testing.T) {
+	bus := i2ctest.Playback{Ops: []i2ctest.IO{wakeOp, versionOp}, DontPanic: true}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &gpiotest.Pin{N: "ALARMB", EdgesChan: make(chan gpio.Level, 1)}
+	if _, err := d.WatchAlarm(p); err != nil {
+		t.Fatal(err)
+	}
+	// Restarting the sensing must not wait for the alarm watch.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if _, err := d.SenseContinuous(time.Millisecond); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- d.Halt()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SenseContinuous or Halt hung")
+	}
+}
+
+func TestCRC8(t *testing.T) {
+	data := []struct {
+		in       []byte
+		expected byte
+	}{
+		{nil, 0x00},
+		{[]byte("123456789"), 0xF4},
+		// Datasheet example: set the IC power mode to operational.
+		{[]byte{0x16, 0x15, 0x01, 0x00}, 0x64},
+		{[]byte{0x16, 0x07, 0x55, 0xAA}, 0x17},
+	}
+	for _, line := range data {
+		if c := CRC8(line.in); c != line.expected {
+			t.Fatalf("CRC8(%#v) = %#x; expected %#x", line.in, c, line.expected)
+		}
+	}
+}
+
+func TestReadRegister(t *testing.T) {
+	// Little endian, followed by the CRC over both address bytes, the command
+	// and the data.
+	r := []byte{0x34, 0x12, 0}
+	r[2] = CRC8([]byte{0x16, 0x1A, 0x17, 0x34, 0x12})
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{0x1A}, R: r},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.ReadRegister(0x1A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0x1234 {
+		t.Fatalf("%#x", v)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteRegister(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regICPowerMode, 0x01, 0x00, 0x64}},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteRegister(regICPowerMode, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemperature(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regCellTemperature}, R: readResp(regCellTemperature, 0x0BA6)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.Temperature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2982 * 0.1K = 298.2K = 25.05°C
+	if v != 2982*100*physic.MilliKelvin {
+		t.Fatal(v)
+	}
+}
+
+func TestSetTemperature(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regCellTemperature, 0x0BA6)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTemperature(physic.ZeroCelsius + 25050*physic.MilliCelsius); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTemperature(physic.ZeroCelsius - 21*physic.Celsius); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetTemperature(physic.ZeroCelsius + 61*physic.Celsius); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTemperatureMode(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regStatusBit}, R: readResp(regStatusBit, 0xFFFE)},
+			{Addr: 0x0B, W: writeReq(regStatusBit, 0xFFFF)},
+			{Addr: 0x0B, W: []byte{regStatusBit}, R: readResp(regStatusBit, 0x8001)},
+			{Addr: 0x0B, W: writeReq(regStatusBit, 0x8000)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTemperatureMode(ThermistorMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTemperatureMode(I2CMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTemperatureMode(2); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestThermistor(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regThermistorB, 0x6B, 0x0D, CRC8([]byte{0x16, regThermistorB, 0x6B, 0x0D})}},
+			{Addr: 0x0B, W: []byte{regThermistorB}, R: readResp(regThermistorB, 3435)},
+			{Addr: 0x0B, W: []byte{regStatusBit}, R: readResp(regStatusBit, 0)},
+			{Addr: 0x0B, W: writeReq(regStatusBit, 1)},
+			{Addr: 0x0B, W: []byte{regCellTemperature}, R: readResp(regCellTemperature, 0x0BA6)},
+			{Addr: 0x0B, W: []byte{regStatusBit}, R: readResp(regStatusBit, 1)},
+			{Addr: 0x0B, W: writeReq(regStatusBit, 0)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetThermistorB(3435); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetThermistorB(0); err == nil {
+		t.Fatal("expected error")
+	}
+	if b, err := d.ThermistorB(); b != 3435 || err != nil {
+		t.Fatal(b, err)
+	}
+	if err := d.SetThermistorMode(true); err != nil {
+		t.Fatal(err)
+	}
+	// 298.2K
+	if v, err := d.Temperature(); v != 298200*physic.MilliKelvin || err != nil {
+		t.Fatal(v, err)
+	}
+	if err := d.SetThermistorMode(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPowerMode_String(t *testing.T) {
+	data := []struct {
+		m        PowerMode
+		expected string
+	}{
+		{Operational, "operational"},
+		{Sleep, "sleep"},
+		{0, "unknown(0x0)"},
+		{0xFFFF, "unknown(0xFFFF)"},
+	}
+	for _, line := range data {
+		if s := line.m.String(); s != line.expected {
+			t.Fatalf("%q != %q", s, line.expected)
+		}
+	}
+}
+
+func TestTemperatureMode_String(t *testing.T) {
+	data := []struct {
+		m        TemperatureMode
+		expected string
+	}{
+		{I2CMode, "i2c"},
+		{ThermistorMode, "thermistor"},
+		{2, "unknown(0x2)"},
+	}
+	for _, line := range data {
+		if s := line.m.String(); s != line.expected {
+			t.Fatalf("%q != %q", s, line.expected)
+		}
+	}
+}
+
+func TestCurrentDirection(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regCurrentDirection, 0x00, 0x00, CRC8([]byte{0x16, regCurrentDirection, 0x00, 0x00})}},
+			{Addr: 0x0B, W: []byte{regCurrentDirection, 0x01, 0x00, CRC8([]byte{0x16, regCurrentDirection, 0x01, 0x00})}},
+			{Addr: 0x0B, W: []byte{regCurrentDirection, 0xFF, 0xFF, CRC8([]byte{0x16, regCurrentDirection, 0xFF, 0xFF})}},
+			{Addr: 0x0B, W: []byte{regCurrentDirection}, R: readResp(regCurrentDirection, 0xFFFF)},
+			{Addr: 0x0B, W: []byte{regCurrentDirection}, R: readResp(regCurrentDirection, 2)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []CurrentDirection{Auto, Charge, Discharge} {
+		if err := d.SetCurrentDirection(c); err != nil {
+			t.Fatal(c, err)
+		}
+	}
+	if err := d.SetCurrentDirection(2); err == nil {
+		t.Fatal("expected error")
+	}
+	if c, err := d.CurrentDirection(); c != Discharge || err != nil {
+		t.Fatal(c, err)
+	}
+	if _, err := d.CurrentDirection(); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCurrentDirection_String(t *testing.T) {
+	data := []struct {
+		c        CurrentDirection
+		expected string
+	}{
+		{Auto, "auto"},
+		{Charge, "charge"},
+		{Discharge, "discharge"},
+		{2, "unknown(0x2)"},
+	}
+	for _, line := range data {
+		if s := line.c.String(); s != line.expected {
+			t.Fatalf("%q != %q", s, line.expected)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	data := []struct {
+		v        uint16
+		expected Status
+	}{
+		{0x0000, Status{TempMode: I2CMode}},
+		{0x0001, Status{TempMode: ThermistorMode, Raw: 0x0001}},
+		// Undefined bits are ignored.
+		{0xFFFE, Status{TempMode: I2CMode, Raw: 0xFFFE}},
+	}
+	for _, line := range data {
+		bus := i2ctest.Playback{
+			Ops: []i2ctest.IO{
+				wakeOp, versionOp,
+				{Addr: 0x0B, W: []byte{regStatusBit}, R: readResp(regStatusBit, line.v)},
+			},
+		}
+		d, err := New(&bus, &DefaultOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := d.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != line.expected {
+			t.Fatalf("%#x: %#v != %#v", line.v, s, line.expected)
+		}
+		if err := bus.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNew_Wake(t *testing.T) {
+	// The first transaction is ignored by a sleeping device.
+	bus := sleepingBus{Playback: i2ctest.Playback{Ops: []i2ctest.IO{wakeOp, versionOp}}}
+	if _, err := New(&bus, &DefaultOpts); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(&i2ctest.Playback{DontPanic: true}, &DefaultOpts); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPowerMode(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regICPowerMode, 2)},
+			{Addr: 0x0B, W: []byte{regICPowerMode}, R: readResp(regICPowerMode, 2)},
+			{Addr: 0x0B, W: writeReq(regICPowerMode, 1)},
+			{Addr: 0x0B, W: []byte{regICPowerMode}, R: readResp(regICPowerMode, 1)},
+			{Addr: 0x0B, W: []byte{regICPowerMode}, R: readResp(regICPowerMode, 3)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []PowerMode{Sleep, Operational} {
+		if err := d.SetPowerMode(m); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := d.PowerMode(); err != nil || v != m {
+			t.Fatal(v, err)
+		}
+	}
+	if _, err := d.PowerMode(); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetPowerMode(0); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLowRSOCAlarm(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regAlarmLowRSOC, 10)},
+			{Addr: 0x0B, W: []byte{regAlarmLowRSOC}, R: readResp(regAlarmLowRSOC, 10)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLowRSOCAlarm(10); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.LowRSOCAlarm(); err != nil || v != 10 {
+		t.Fatal(v, err)
+	}
+	if err := d.SetLowRSOCAlarm(-1); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetLowRSOCAlarm(101); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLowVoltageAlarm(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			// 3300mV is 0x0CE4, sent little endian.
+			{Addr: 0x0B, W: []byte{regAlarmLowVoltage, 0xE4, 0x0C, CRC8([]byte{0x16, regAlarmLowVoltage, 0xE4, 0x0C})}},
+			{Addr: 0x0B, W: []byte{regAlarmLowVoltage}, R: readResp(regAlarmLowVoltage, 3300)},
+			{Addr: 0x0B, W: writeReq(regAlarmLowVoltage, 0)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLowVoltageAlarm(3300 * physic.MilliVolt); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.LowVoltageAlarm(); err != nil || v != 3300*physic.MilliVolt {
+		t.Fatal(v, err)
+	}
+	// Rounded to the millivolt.
+	if err := d.SetLowVoltageAlarm(400 * physic.MicroVolt); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLowVoltageAlarm(-physic.MilliVolt); err == nil {
+		t.Fatal("expected error")
+	}
+	// Outside of the cell voltage range.
+	for _, v := range []physic.ElectricPotential{2499 * physic.MilliVolt, 5001 * physic.MilliVolt, 65536 * physic.MilliVolt} {
+		if err := d.SetLowVoltageAlarm(v); err == nil {
+			t.Fatalf("%s: expected error", v)
+		}
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAlarmStatus(t *testing.T) {
+	data := []struct {
+		rsocAlarm, rsoc       uint16
+		voltageAlarm, voltage uint16
+		lowRSOC, lowVoltage   bool
+	}{
+		// Both alarms are disabled.
+		{0, 0, 0, 0, false, false},
+		{10, 9, 3300, 3400, true, false},
+		{10, 10, 3300, 3299, false, true},
+		{10, 5, 3300, 3000, true, true},
+	}
+	for _, line := range data {
+		ops := append([]i2ctest.IO{wakeOp, versionOp}, alarmStatusOps(line.rsocAlarm, line.rsoc, line.voltageAlarm, line.voltage)...)
+		bus := i2ctest.Playback{Ops: ops}
+		d, err := New(&bus, &DefaultOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lowRSOC, lowVoltage, err := d.AlarmStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lowRSOC != line.lowRSOC || lowVoltage != line.lowVoltage {
+			t.Fatalf("%#v: %t %t", line, lowRSOC, lowVoltage)
+		}
+		if err := bus.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatchAlarm(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+		},
+	}
+	bus.Ops = append(bus.Ops, alarmStatusOps(10, 5, 3300, 3400)...)
+	bus.Ops = append(bus.Ops, alarmStatusOps(10, 50, 3300, 3000)...)
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &gpiotest.Pin{N: "ALARMB", EdgesChan: make(chan gpio.Level, 1)}
+	c, err := d.WatchAlarm(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.WatchAlarm(p); err == nil {
+		t.Fatal("expected error while already watching")
+	}
+	p.EdgesChan <- gpio.Low
+	if e := <-c; e != (AlarmEvent{LowRSOC: true}) {
+		t.Fatalf("%#v", e)
+	}
+	p.EdgesChan <- gpio.Low
+	if e := <-c; e != (AlarmEvent{LowVoltage: true}) {
+		t.Fatalf("%#v", e)
+	}
+	if err := d.Halt(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-c; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchAlarm_Fail(t *testing.T) {
+	bus := i2ctest.Playback{Ops: []i2ctest.IO{wakeOp, versionOp}, DontPanic: true}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pin doesn't support edge detection.
+	if _, err := d.WatchAlarm(&gpiotest.Pin{N: "ALARMB"}); err == nil {
+		t.Fatal("expected error")
+	}
+	p := &gpiotest.Pin{N: "ALARMB", EdgesChan: make(chan gpio.Level, 1)}
+	c, err := d.WatchAlarm(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reading the status fails, which closes the channel.
+	p.EdgesChan <- gpio.Low
+	if _, ok := <-c; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+	if err := d.Halt(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetAPA(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regAPA, 0x08, 0x00, CRC8([]byte{0x16, regAPA, 0x08, 0x00})}},
+			{Addr: 0x0B, W: []byte{regAPA, 0x2D, 0x00, CRC8([]byte{0x16, regAPA, 0x2D, 0x00})}},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetAPA(APA100mAh); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetAPA(APA2000mAh); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetBatteryProfile(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regChangeOfParameter, 1)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetBatteryProfile(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetBatteryProfile(2); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_Addr(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			{Addr: 0x0C, W: writeReqAt(0x0C, regICPowerMode, 1)},
+			{Addr: 0x0C, W: []byte{regICVersion}, R: readRespAt(0x0C, regICVersion, 0x2717)},
+			{Addr: 0x0C, W: []byte{regRSOC}, R: readRespAt(0x0C, regRSOC, 42)},
+		},
+	}
+	d, err := New(&bus, &Opts{Addr: 0x0C})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.RSOC(); v != 42 || err != nil {
+		t.Fatal(v, err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 0 is the default address.
+	bus = i2ctest.Playback{Ops: []i2ctest.IO{wakeOp, versionOp}}
+	if _, err := New(&bus, &Opts{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(&i2ctest.Playback{}, &Opts{Addr: 0x80}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNew_Opts(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regAPA, uint16(APA1000mAh))},
+			{Addr: 0x0B, W: writeReq(regChangeOfParameter, 1)},
+			{Addr: 0x0B, W: writeReq(regThermistorB, 3435)},
+			{Addr: 0x0B, W: []byte{regStatusBit}, R: readResp(regStatusBit, 0)},
+			{Addr: 0x0B, W: writeReq(regStatusBit, uint16(ThermistorMode))},
+			{Addr: 0x0B, W: writeReq(regBeforeRSOC, 0xAA55)},
+			{Addr: 0x0B, W: writeReq(regInitialRSOC, 0xAA55)},
+		},
+	}
+	opts := Opts{APA: APA1000mAh, Profile: 1, ThermistorB: 3435, TempMode: ThermistorMode}
+	if _, err := New(&bus, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_Opts_Fail(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regAPA, uint16(APA1000mAh))},
+		},
+	}
+	_, err := New(&bus, &Opts{APA: APA1000mAh, Profile: 2})
+	if err == nil || err.Error() != "lc709203: set battery profile: invalid battery profile" {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_Opts_NoAPA(t *testing.T) {
+	data := []Opts{
+		{Profile: 1},
+		{ThermistorB: 3435},
+		{TempMode: ThermistorMode},
+	}
+	for _, opts := range data {
+		// The bus is not accessed.
+		bus := i2ctest.Playback{}
+		if _, err := New(&bus, &opts); err == nil {
+			t.Fatalf("%+v: expected error", opts)
+		}
+		if err := bus.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNew_NilOpts(t *testing.T) {
+	bus := i2ctest.Playback{Ops: []i2ctest.IO{wakeOp, versionOp}}
+	if _, err := New(&bus, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_Version(t *testing.T) {
+	for _, v := range []uint16{0, 0xFFFF} {
+		bus := i2ctest.Playback{
+			Ops: []i2ctest.IO{
+				wakeOp,
+				{Addr: 0x0B, W: []byte{regICVersion}, R: readResp(regICVersion, v)},
+			},
+		}
+		if _, err := New(&bus, &DefaultOpts); err == nil {
+			t.Fatalf("%#x: expected error", v)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	bus := &regBus{regs: map[byte]uint16{regICVersion: 0x2717}}
+	d, err := New(bus, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.writes = nil
+	c := Config{
+		APA:             APA1000mAh,
+		Profile:         1,
+		LowRSOCAlarm:    10,
+		LowVoltageAlarm: 3300 * physic.MilliVolt,
+		TempMode:        ThermistorMode,
+		PowerMode:       Sleep,
+	}
+	if err := d.SetConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	// Woken up first, put to sleep last.
+	expected := []byte{regICPowerMode, regAPA, regChangeOfParameter, regStatusBit, regAlarmLowRSOC, regAlarmLowVoltage, regICPowerMode}
+	if !reflect.DeepEqual(bus.writes, expected) {
+		t.Fatalf("%#v != %#v", bus.writes, expected)
+	}
+	got, err := d.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Fatalf("%#v != %#v", got, c)
+	}
+	// Operational is not written again.
+	bus.writes = nil
+	c.PowerMode = Operational
+	if err := d.SetConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(bus.writes) != 6 {
+		t.Fatalf("%#v", bus.writes)
+	}
+	if got, err := d.Config(); err != nil || got != c {
+		t.Fatalf("%#v, %v", got, err)
+	}
+}
+
+func TestSetConfig_Fail(t *testing.T) {
+	bus := &regBus{regs: map[byte]uint16{regICVersion: 0x2717}}
+	d, err := New(bus, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.writes = nil
+	err = d.SetConfig(Config{APA: APA1000mAh, Profile: 2, PowerMode: Operational})
+	if err == nil || err.Error() != "lc709203: set battery profile: invalid battery profile" {
+		t.Fatal(err)
+	}
+	if err := d.SetConfig(Config{PowerMode: 3}); err == nil {
+		t.Fatal("expected error")
+	}
+	// The zero value is not a valid power mode.
+	err = d.SetConfig(Config{APA: APA1000mAh})
+	if err == nil || err.Error() != "lc709203: set power mode: invalid power mode" {
+		t.Fatal(err)
+	}
+	// Nothing is written when the configuration is invalid.
+	if len(bus.writes) != 0 {
+		t.Fatalf("%#v", bus.writes)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regICVersion}, R: []byte{0x17, 0x27, CRC8([]byte{0x16, regICVersion, 0x17, 0x17, 0x27})}},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Version(); err != nil || v != 0x2717 {
+		t.Fatal(v, err)
+	}
+}
+
+func TestInitRSOC(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: []byte{regInitialRSOC, 0x55, 0xAA, 0x17}},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.InitRSOC(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuickStart(t *testing.T) {
+	bus := i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regICPowerMode, 1)},
+			{Addr: 0x0B, W: writeReq(regAPA, uint16(APA1000mAh))},
+			{Addr: 0x0B, W: writeReq(regChangeOfParameter, 1)},
+			{Addr: 0x0B, W: writeReq(regBeforeRSOC, 0xAA55)},
+			{Addr: 0x0B, W: writeReq(regInitialRSOC, 0xAA55)},
+		},
+	}
+	d, err := New(&bus, &DefaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.QuickStart(APA1000mAh, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Stops at the first invalid value.
+	bus = i2ctest.Playback{
+		Ops: []i2ctest.IO{
+			wakeOp, versionOp,
+			{Addr: 0x0B, W: writeReq(regICPowerMode, 1)},
+			{Addr: 0x0B, W: writeReq(regAPA, uint16(APA1000mAh))},
+		},
+	}
+	if d, err = New(&bus, &DefaultOpts); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.QuickStart(APA1000mAh, 2); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//
+
+// wakeOp and versionOp are the transactions done by New.
+var (
+	wakeOp    = i2ctest.IO{Addr: 0x0B, W: writeReq(regICPowerMode, 1)}
+	versionOp = i2ctest.IO{Addr: 0x0B, W: []byte{regICVersion}, R: readResp(regICVersion, 0x2717)}
+)
+
+// readResp returns the bytes the device sends when reading register cmd with
+// value v, including the CRC.
+func readResp(cmd byte, v uint16) []byte {
+	return readRespAt(I2CAddr, cmd, v)
+}
+
+// alarmStatusOps returns the transactions of AlarmStatus, with the given
+// thresholds and measured values. The measured values are only read when the
+// threshold is not 0.
+func alarmStatusOps(rsocAlarm, rsoc, voltageAlarm, voltage uint16) []i2ctest.IO {
+	ops := []i2ctest.IO{{Addr: 0x0B, W: []byte{regAlarmLowRSOC}, R: readResp(regAlarmLowRSOC, rsocAlarm)}}
+	if rsocAlarm != 0 {
+		ops = append(ops, i2ctest.IO{Addr: 0x0B, W: []byte{regRSOC}, R: readResp(regRSOC, rsoc)})
+	}
+	ops = append(ops, i2ctest.IO{Addr: 0x0B, W: []byte{regAlarmLowVoltage}, R: readResp(regAlarmLowVoltage, voltageAlarm)})
+	if voltageAlarm != 0 {
+		ops = append(ops, i2ctest.IO{Addr: 0x0B, W: []byte{regCellVoltage}, R: readResp(regCellVoltage, voltage)})
+	}
+	return ops
+}
+
+// readRespAt is like readResp for a device at address addr.
+func readRespAt(addr uint16, cmd byte, v uint16) []byte {
+	a := byte(addr << 1)
+	r := []byte{byte(v), byte(v >> 8), 0}
+	r[2] = CRC8([]byte{a, cmd, a | 1, r[0], r[1]})
+	return r
+}
+
+// writeReq returns the bytes to write register cmd with value v, including
+// the CRC.
+func writeReq(cmd byte, v uint16) []byte {
+	return writeReqAt(I2CAddr, cmd, v)
+}
+
+// writeReqAt is like writeReq for a device at address addr.
+func writeReqAt(addr uint16, cmd byte, v uint16) []byte {
+	w := []byte{cmd, byte(v), byte(v >> 8), 0}
+	w[3] = CRC8([]byte{byte(addr << 1), w[0], w[1], w[2]})
+	return w
+}
+
+// regBus simulates the registers of a device.
+type regBus struct {
+	regs   map[byte]uint16
+	writes []byte // Registers written, in order.
+}
+
+func (r *regBus) String() string {
+	return "regBus"
+}
+
+func (r *regBus) Tx(addr uint16, w, b []byte) error {
+	a := byte(addr << 1)
+	switch {
+	case len(w) == 4 && len(b) == 0:
+		if CRC8([]byte{a, w[0], w[1], w[2]}) != w[3] {
+			return errors.New("invalid CRC")
+		}
+		r.regs[w[0]] = uint16(w[1]) | uint16(w[2])<<8
+		r.writes = append(r.writes, w[0])
+	case len(w) == 1 && len(b) == 3:
+		copy(b, readRespAt(addr, w[0], r.regs[w[0]]))
+	default:
+		return errors.New("unexpected transaction")
+	}
+	return nil
+}
+
+func (r *regBus) SetSpeed(f physic.Frequency) error {
+	return nil
+}
+
+// sleepingBus fails the first transaction.
+type sleepingBus struct {
+	i2ctest.Playback
+	awake bool
+}
+
+func (s *sleepingBus) Tx(addr uint16, w, r []byte) error {
+	if !s.awake {
+		s.awake = true
+		return errors.New("NACK")
+	}
+	return s.Playback.Tx(addr, w, r)
+}